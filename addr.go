@@ -0,0 +1,421 @@
+package zelda
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// --- [ Binary replacements ] -------------------------------------------------
+
+// Replacements is a set of binary replacements.
+type Replacements []Replacement
+
+// Set sets the binary replacements based on the given string.
+func (rs *Replacements) Set(s string) error {
+	parts := strings.Split(s, ",")
+	for _, part := range parts {
+		var r Replacement
+		part = strings.TrimSpace(part)
+		if err := r.Set(part); err != nil {
+			return errors.WithStack(err)
+		}
+		*rs = append(*rs, r)
+	}
+	return nil
+}
+
+// String returns the string representation of the binary replacements.
+func (rs Replacements) String() string {
+	var ss []string
+	for _, r := range rs {
+		s := r.String()
+		ss = append(ss, s)
+	}
+	return strings.Join(ss, ",")
+}
+
+// Replacement is a binary replacement specified by address.
+type Replacement struct {
+	// Start address of binary replacement.
+	Addr Address
+	// New content.
+	Buf []byte
+	// (optional) Expected original content.
+	Expect *Expected
+}
+
+// Set sets the binary replacement based on the given string (e.g. "0x10:DEAD"
+// or "0x10:DEAD=BEEF" to replace the expected content BEEF with DEAD).
+func (r *Replacement) Set(s string) error {
+	s, expect := cutExpected(s)
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return errors.Errorf("invalid number of colon-separated parts in binary replacement; expected 2, got %d", len(parts))
+	}
+	if err := r.Addr.Set(parts[0]); err != nil {
+		return errors.WithStack(err)
+	}
+	buf, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	r.Buf = buf
+	r.Expect = nil
+	if len(expect) > 0 {
+		r.Expect = &Expected{}
+		if err := r.Expect.Set(expect); err != nil {
+			return errors.WithStack(err)
+		}
+		if r.Expect.Buf != nil && len(r.Expect.Buf) != len(r.Buf) {
+			return errors.Errorf("length mismatch between new and expected content of binary replacement at address %s; expected %d bytes, got %d bytes", r.Addr, len(r.Buf), len(r.Expect.Buf))
+		}
+	}
+	return nil
+}
+
+// String returns the string representation of the binary replacement.
+func (r Replacement) String() string {
+	s := fmt.Sprintf("%s:%X", r.Addr, r.Buf)
+	if r.Expect != nil {
+		s += "=" + r.Expect.String()
+	}
+	return s
+}
+
+// UnmarshalText unmarshals the text into r.
+func (r *Replacement) UnmarshalText(text []byte) error {
+	return r.Set(string(text))
+}
+
+// MarshalText returns the textual representation of r.
+func (r Replacement) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// --- [ Assembly patches ] ----------------------------------------------------
+
+// AsmPatches is a set of assembly patches.
+type AsmPatches []AsmPatch
+
+// Set adds the assembly patch specified by the given string to the set of
+// assembly patches. As instruction operands are comma-separated, each assembly
+// patch is specified separately.
+func (ps *AsmPatches) Set(s string) error {
+	var p AsmPatch
+	if err := p.Set(s); err != nil {
+		return errors.WithStack(err)
+	}
+	*ps = append(*ps, p)
+	return nil
+}
+
+// String returns the string representation of the assembly patches.
+func (ps AsmPatches) String() string {
+	var ss []string
+	for _, p := range ps {
+		s := p.String()
+		ss = append(ss, s)
+	}
+	return strings.Join(ss, " | ")
+}
+
+// AsmPatch is a patch of an address range with assembly instructions, which are
+// encoded by the assembler.
+type AsmPatch struct {
+	// Address range of patch; a single address is not accepted. The encoded
+	// instructions must fit within the address range, and any remaining bytes
+	// are filled with NOP instructions.
+	Range AddrRange
+	// Assembly instructions in NASM syntax.
+	Insts []string
+}
+
+// Set sets the assembly patch based on the given string.
+func (p *AsmPatch) Set(s string) error {
+	// Skip the colon of the SHA-1 hash of the expected original content (e.g.
+	// "0x10-0x16=sha1:HASH: ret"), when locating the colon separating the
+	// address range from the instructions.
+	start := 0
+	if pos := strings.Index(s, "="+sha1Prefix); pos != -1 {
+		start = pos + len("="+sha1Prefix)
+	}
+	pos := strings.Index(s[start:], ":")
+	if pos == -1 {
+		return errors.Errorf("invalid assembly patch %q; missing colon-separated instructions", s)
+	}
+	pos += start
+	parts := []string{s[:pos], s[pos+1:]}
+	if rng, _ := cutExpected(parts[0]); !strings.Contains(rng, "-") {
+		// The address range is required to check overlapping patches before the
+		// instructions are encoded by the assembler.
+		return errors.Errorf("invalid assembly patch %q; missing end address of address range (e.g. \"0x401000-0x401006: ret\")", s)
+	}
+	if err := p.Range.Set(strings.TrimSpace(parts[0])); err != nil {
+		return errors.WithStack(err)
+	}
+	p.Insts = nil
+	for _, inst := range strings.Split(parts[1], ";") {
+		inst = strings.TrimSpace(inst)
+		if len(inst) == 0 {
+			continue
+		}
+		p.Insts = append(p.Insts, inst)
+	}
+	if len(p.Insts) == 0 {
+		return errors.Errorf("missing instructions of assembly patch at address range %q", p.Range)
+	}
+	return nil
+}
+
+// String returns the string representation of the assembly patch.
+func (p AsmPatch) String() string {
+	return fmt.Sprintf("%s: %s", p.Range, strings.Join(p.Insts, "; "))
+}
+
+// UnmarshalText unmarshals the text into p.
+func (p *AsmPatch) UnmarshalText(text []byte) error {
+	return p.Set(string(text))
+}
+
+// MarshalText returns the textual representation of p.
+func (p AsmPatch) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// --- [ Address ranges ] ------------------------------------------------------
+
+// AddrRanges is a set of address ranges.
+type AddrRanges []AddrRange
+
+// Contains reports whether the address range contains the given address.
+func (as AddrRanges) Contains(addr Address) bool {
+	for _, a := range as {
+		if a.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Set sets the address ranges based on the given string.
+func (as *AddrRanges) Set(s string) error {
+	parts := strings.Split(s, ",")
+	for _, part := range parts {
+		var a AddrRange
+		part = strings.TrimSpace(part)
+		if err := a.Set(part); err != nil {
+			return errors.WithStack(err)
+		}
+		*as = append(*as, a)
+	}
+	return nil
+}
+
+// String returns the string representation of the address ranges.
+func (as AddrRanges) String() string {
+	var ss []string
+	for _, a := range as {
+		s := a.String()
+		ss = append(ss, s)
+	}
+	return strings.Join(ss, ",")
+}
+
+// AddrRange defines the address range [start, end).
+type AddrRange struct {
+	// Start address, inclusive.
+	Start Address
+	// End address, exclusive.
+	End Address
+	// (optional) Expected original content of address range.
+	Expect *Expected
+}
+
+// Contains reports whether the address range contains the given address.
+func (a AddrRange) Contains(addr Address) bool {
+	return a.Start <= addr && addr < a.End
+}
+
+// Set sets the address range based on the given string (e.g. "0x10-0x12" or
+// "0x10-0x12=9090" with the expected content 9090).
+func (a *AddrRange) Set(s string) error {
+	s, expect := cutExpected(s)
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return errors.Errorf("invalid number of dash-separated parts in address range; expected 2, got %d", len(parts))
+	}
+	if err := a.Start.Set(parts[0]); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := a.End.Set(parts[1]); err != nil {
+		return errors.WithStack(err)
+	}
+	if a.End <= a.Start {
+		return errors.Errorf("invalid address range %s-%s; end address must be greater than start address", a.Start, a.End)
+	}
+	a.Expect = nil
+	if len(expect) > 0 {
+		a.Expect = &Expected{}
+		if err := a.Expect.Set(expect); err != nil {
+			return errors.WithStack(err)
+		}
+		if a.Expect.Buf != nil && Address(len(a.Expect.Buf)) != a.End-a.Start {
+			return errors.Errorf("length mismatch between address range %s-%s and its expected content; expected %d bytes, got %d bytes", a.Start, a.End, a.End-a.Start, len(a.Expect.Buf))
+		}
+	}
+	return nil
+}
+
+// String returns the string representation of the address range.
+func (a AddrRange) String() string {
+	s := fmt.Sprintf("%s-%s", a.Start, a.End)
+	if a.Expect != nil {
+		s += "=" + a.Expect.String()
+	}
+	return s
+}
+
+// UnmarshalText unmarshals the text into a.
+func (a *AddrRange) UnmarshalText(text []byte) error {
+	return a.Set(string(text))
+}
+
+// MarshalText returns the textual representation of a.
+func (a AddrRange) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// --- [ Expected content ] ----------------------------------------------------
+
+// sha1Prefix is the prefix of SHA-1 hashes of expected content.
+const sha1Prefix = "sha1:"
+
+// Expected is the expected original content of a patched address range,
+// specified either as raw bytes or as a SHA-1 hash.
+type Expected struct {
+	// Expected content; or nil if specified by hash.
+	Buf []byte
+	// SHA-1 hash of expected content; or nil if specified by raw bytes.
+	SHA1 []byte
+}
+
+// Set sets the expected content based on the given string (e.g. "558BEC" or
+// "sha1:HASH").
+func (e *Expected) Set(s string) error {
+	e.Buf, e.SHA1 = nil, nil
+	if strings.HasPrefix(s, sha1Prefix) {
+		hash, err := hex.DecodeString(s[len(sha1Prefix):])
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if len(hash) != sha1.Size {
+			return errors.Errorf("invalid length of SHA-1 hash %q; expected %d bytes, got %d bytes", s, sha1.Size, len(hash))
+		}
+		e.SHA1 = hash
+		return nil
+	}
+	buf, err := hex.DecodeString(s)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	e.Buf = buf
+	return nil
+}
+
+// String returns the string representation of the expected content.
+func (e Expected) String() string {
+	if e.SHA1 != nil {
+		return fmt.Sprintf("%s%x", sha1Prefix, e.SHA1)
+	}
+	return fmt.Sprintf("%X", e.Buf)
+}
+
+// Check reports whether the given original content matches the expected
+// content. If not, the returned error presents a diff of the expected and
+// actual content.
+func (e Expected) Check(addr Address, actual []byte) error {
+	if e.SHA1 != nil {
+		hash := sha1.Sum(actual)
+		if bytes.Equal(hash[:], e.SHA1) {
+			return nil
+		}
+		return errors.Errorf("content mismatch at address %s\n  expected: %s%x\n  actual:   %s%x\n  content:  % X", addr, sha1Prefix, e.SHA1, sha1Prefix, hash[:], actual)
+	}
+	if bytes.Equal(actual, e.Buf) {
+		return nil
+	}
+	// Mark differing bytes.
+	marks := &strings.Builder{}
+	for i := range actual {
+		switch {
+		case i >= len(e.Buf) || actual[i] != e.Buf[i]:
+			marks.WriteString("^^ ")
+		default:
+			marks.WriteString("   ")
+		}
+	}
+	return errors.Errorf("content mismatch at address %s\n  expected: % X\n  actual:   % X\n            %s", addr, e.Buf, actual, strings.TrimRight(marks.String(), " "))
+}
+
+// cutExpected cuts the "=EXPECTED" suffix specifying the expected original
+// content from the given patch string.
+func cutExpected(s string) (patch, expect string) {
+	pos := strings.Index(s, "=")
+	if pos == -1 {
+		return s, ""
+	}
+	return s[:pos], s[pos+1:]
+}
+
+// Address is a virtual address, which may be specified in hexadecimal notation.
+// It implements the flag.Value, encoding.TextUnmarshaler and
+// metadata.Unmarshaler interfaces.
+type Address uint64
+
+// Set sets the address based on the given string.
+func (a *Address) Set(s string) error {
+	x, err := parseHex(s)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	*a = Address(x)
+	return nil
+}
+
+// String returns the string representation of the address.
+func (a Address) String() string {
+	return fmt.Sprintf("0x%X", uint64(a))
+}
+
+// UnmarshalText unmarshals the text into a.
+func (a *Address) UnmarshalText(text []byte) error {
+	return a.Set(string(text))
+}
+
+// MarshalText returns the textual representation of a.
+func (a Address) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// ### [ Helper functions ] ####################################################
+
+// parseHex parses the hexadecimal representation of an unsigned integer.
+func parseHex(s string) (uint64, error) {
+	s = strings.ToLower(s)
+	const prefix = "0x"
+	if !strings.HasPrefix(s, prefix) {
+		return 0, errors.Errorf("invalid address %q; missing hexadecimal prefix %q", s, prefix)
+	}
+	s = s[len(prefix):]
+	x, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return x, nil
+}
@@ -0,0 +1,266 @@
+package zelda
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestAddrRangeSet(t *testing.T) {
+	golden := []struct {
+		s          string
+		start, end Address
+		err        string
+	}{
+		{s: "0x10-0x12", start: 0x10, end: 0x12},
+		{s: "0x401000-0x401001", start: 0x401000, end: 0x401001},
+		{s: "0x10-0x10", err: "invalid address range 0x10-0x10; end address must be greater than start address"},
+		{s: "0x12-0x10", err: "invalid address range 0x12-0x10; end address must be greater than start address"},
+		{s: "0x10", err: "invalid number of dash-separated parts in address range; expected 2, got 1"},
+		{s: "0x10-0x12-0x14", err: "invalid number of dash-separated parts in address range; expected 2, got 3"},
+	}
+	for _, g := range golden {
+		var a AddrRange
+		err := a.Set(g.s)
+		if !checkErr(t, g.s, err, g.err) {
+			continue
+		}
+		if a.Start != g.start || a.End != g.end {
+			t.Errorf("%s: address range mismatch; expected %s-%s, got %s-%s", g.s, g.start, g.end, a.Start, a.End)
+		}
+		if s := a.String(); s != g.s {
+			t.Errorf("%s: string mismatch; expected %q, got %q", g.s, g.s, s)
+		}
+	}
+}
+
+func TestAsmPatchSet(t *testing.T) {
+	const hash = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	golden := []struct {
+		s          string
+		start, end Address
+		insts      []string
+		expect     string
+		// String representation; or empty if same as s.
+		str string
+		err string
+	}{
+		{
+			s:     "0x10-0x16: mov eax, 1; ret",
+			start: 0x10, end: 0x16,
+			insts: []string{"mov eax, 1", "ret"},
+		},
+		{
+			s:     "0x401000-0x401005:mov eax,[0x404000] ;; ret;",
+			start: 0x401000, end: 0x401005,
+			insts: []string{"mov eax,[0x404000]", "ret"},
+			str:   "0x401000-0x401005: mov eax,[0x404000]; ret",
+		},
+		{
+			s:     "0x10-0x12=9090: ret",
+			start: 0x10, end: 0x12,
+			insts:  []string{"ret"},
+			expect: "9090",
+		},
+		{
+			s:     "0x10-0x16=sha1:" + hash + ": xor eax, eax; ret",
+			start: 0x10, end: 0x16,
+			insts:  []string{"xor eax, eax", "ret"},
+			expect: "sha1:" + hash,
+		},
+		{
+			s:   "0x10-0x16 ret",
+			err: `invalid assembly patch "0x10-0x16 ret"; missing colon-separated instructions`,
+		},
+		{
+			s:   "0x10-0x16: ; ",
+			err: `missing instructions of assembly patch at address range "0x10-0x16"`,
+		},
+		{
+			s:   "0x401000: ret",
+			err: `invalid assembly patch "0x401000: ret"; missing end address of address range (e.g. "0x401000-0x401006: ret")`,
+		},
+		{
+			s:   "0x10=C3: ret",
+			err: `invalid assembly patch "0x10=C3: ret"; missing end address of address range`,
+		},
+		{
+			s:   "0x16-0x10: ret",
+			err: "invalid address range 0x16-0x10; end address must be greater than start address",
+		},
+		{
+			s:   "0x10-0x12=909090: ret",
+			err: "length mismatch between address range 0x10-0x12 and its expected content; expected 2 bytes, got 3 bytes",
+		},
+	}
+	for _, g := range golden {
+		var p AsmPatch
+		err := p.Set(g.s)
+		if !checkErr(t, g.s, err, g.err) {
+			continue
+		}
+		if p.Range.Start != g.start || p.Range.End != g.end {
+			t.Errorf("%s: address range mismatch; expected %s-%s, got %s-%s", g.s, g.start, g.end, p.Range.Start, p.Range.End)
+		}
+		if !reflect.DeepEqual(p.Insts, g.insts) {
+			t.Errorf("%s: instructions mismatch; expected %q, got %q", g.s, g.insts, p.Insts)
+		}
+		var expect string
+		if p.Range.Expect != nil {
+			expect = p.Range.Expect.String()
+		}
+		if expect != g.expect {
+			t.Errorf("%s: expected content mismatch; expected %q, got %q", g.s, g.expect, expect)
+		}
+		want := g.str
+		if len(want) == 0 {
+			want = g.s
+		}
+		if s := p.String(); s != want {
+			t.Errorf("%s: string mismatch; expected %q, got %q", g.s, want, s)
+		}
+	}
+}
+
+func TestExpectedSet(t *testing.T) {
+	const hash = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	golden := []struct {
+		s    string
+		buf  []byte
+		sha1 string
+		str  string
+		err  string
+	}{
+		{s: "558BEC", buf: []byte{0x55, 0x8B, 0xEC}, str: "558BEC"},
+		{s: "558bec", buf: []byte{0x55, 0x8B, 0xEC}, str: "558BEC"},
+		{s: "sha1:" + hash, sha1: hash, str: "sha1:" + hash},
+		{s: "sha1:DA39A3EE5E6B4B0D3255BFEF95601890AFD80709", sha1: hash, str: "sha1:" + hash},
+		{s: "sha1:da39a3", err: `invalid length of SHA-1 hash "sha1:da39a3"; expected 20 bytes, got 3 bytes`},
+		{s: "sha1:xyz", err: "encoding/hex: invalid byte"},
+		{s: "55 8B", err: "encoding/hex: invalid byte"},
+		{s: "558", err: "encoding/hex: odd length hex string"},
+	}
+	for _, g := range golden {
+		var e Expected
+		err := e.Set(g.s)
+		if !checkErr(t, g.s, err, g.err) {
+			continue
+		}
+		if !bytes.Equal(e.Buf, g.buf) {
+			t.Errorf("%s: expected content mismatch; expected % X, got % X", g.s, g.buf, e.Buf)
+		}
+		if sha1 := hex.EncodeToString(e.SHA1); sha1 != g.sha1 {
+			t.Errorf("%s: SHA-1 hash mismatch; expected %q, got %q", g.s, g.sha1, sha1)
+		}
+		if s := e.String(); s != g.str {
+			t.Errorf("%s: string mismatch; expected %q, got %q", g.s, g.str, s)
+		}
+	}
+}
+
+func TestExpectedCheck(t *testing.T) {
+	golden := []struct {
+		name   string
+		expect string
+		actual []byte
+		err    string
+	}{
+		{name: "bytes match", expect: "558BEC", actual: []byte{0x55, 0x8B, 0xEC}},
+		{name: "bytes mismatch", expect: "558BEC", actual: []byte{0x55, 0x89, 0xE5}, err: "content mismatch at address 0x401000\n  expected: 55 8B EC\n  actual:   55 89 E5\n               ^^ ^^"},
+		{name: "hash match", expect: "sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709", actual: []byte{}},
+		{name: "hash mismatch", expect: "sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709", actual: []byte{0x90}, err: "content mismatch at address 0x401000\n  expected: sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+	}
+	for _, g := range golden {
+		var e Expected
+		if err := e.Set(g.expect); err != nil {
+			t.Errorf("%s: unable to parse expected content; %v", g.name, err)
+			continue
+		}
+		checkErr(t, g.name, e.Check(0x401000, g.actual), g.err)
+	}
+}
+
+func TestCutExpected(t *testing.T) {
+	golden := []struct {
+		s      string
+		patch  string
+		expect string
+	}{
+		{s: "0x10-0x12", patch: "0x10-0x12"},
+		{s: "0x10-0x12=9090", patch: "0x10-0x12", expect: "9090"},
+		{s: "0x10:DEAD=sha1:HASH", patch: "0x10:DEAD", expect: "sha1:HASH"},
+		{s: "0x10-0x12=", patch: "0x10-0x12"},
+	}
+	for _, g := range golden {
+		patch, expect := cutExpected(g.s)
+		if patch != g.patch || expect != g.expect {
+			t.Errorf("%s: mismatch; expected (%q, %q), got (%q, %q)", g.s, g.patch, g.expect, patch, expect)
+		}
+	}
+}
+
+func TestReplacementSet(t *testing.T) {
+	golden := []struct {
+		s      string
+		addr   Address
+		buf    []byte
+		expect string
+		err    string
+	}{
+		{s: "0x10:DEAD", addr: 0x10, buf: []byte{0xDE, 0xAD}},
+		{s: "0x10:DEAD=C390", addr: 0x10, buf: []byte{0xDE, 0xAD}, expect: "C390"},
+		{s: "0x10:DEAD=sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709", addr: 0x10, buf: []byte{0xDE, 0xAD}, expect: "sha1:da39a3ee5e6b4b0d3255bfef95601890afd80709"},
+		{s: "0x10:DEAD=C3", err: "length mismatch between new and expected content of binary replacement at address 0x10; expected 2 bytes, got 1 bytes"},
+		{s: "0x10", err: "invalid number of colon-separated parts in binary replacement; expected 2, got 1"},
+	}
+	for _, g := range golden {
+		var r Replacement
+		err := r.Set(g.s)
+		if !checkErr(t, g.s, err, g.err) {
+			continue
+		}
+		if r.Addr != g.addr || !bytes.Equal(r.Buf, g.buf) {
+			t.Errorf("%s: binary replacement mismatch; expected %s:%X, got %s:%X", g.s, g.addr, g.buf, r.Addr, r.Buf)
+		}
+		var expect string
+		if r.Expect != nil {
+			expect = r.Expect.String()
+		}
+		if expect != g.expect {
+			t.Errorf("%s: expected content mismatch; expected %q, got %q", g.s, g.expect, expect)
+		}
+		if s := r.String(); s != g.s {
+			t.Errorf("%s: string mismatch; expected %q, got %q", g.s, g.s, s)
+		}
+	}
+}
+
+func TestAsmPatchesPrinter(t *testing.T) {
+	var p AsmPatch
+	if err := p.Set("0x401000-0x401006: mov eax, 1; ret"); err != nil {
+		t.Fatalf("unable to parse assembly patch; %v", err)
+	}
+	f, err := getAsmPatchesPrinter(AsmPatches{p})
+	if err != nil {
+		t.Fatalf("unable to create assembly patches printer; %v", err)
+	}
+	buf := &bytes.Buffer{}
+	n, err := f(buf, 0x401000, make([]byte, 0x10))
+	if err != nil {
+		t.Fatalf("unable to print assembly patch; %v", err)
+	}
+	if n != 6 {
+		t.Errorf("number of patched bytes mismatch; expected 6, got %d", n)
+	}
+	const want = "  .patch_00401000:\n" +
+		"\tmov eax, 1\n" +
+		"\tret\n" +
+		"%if ($ - .patch_00401000) > 6\n" +
+		"  %error \"assembly patch at 0x401000-0x401006 exceeds its address range of 6 bytes\"\n" +
+		"%endif\n" +
+		"  times (6 - ($ - .patch_00401000)) nop\n"
+	if got := buf.String(); got != want {
+		t.Errorf("listing mismatch; expected %q, got %q", want, got)
+	}
+}
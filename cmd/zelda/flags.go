@@ -0,0 +1,191 @@
+package main
+
+import (
+	"flag"
+
+	"github.com/mewkiz/pkg/jsonutil"
+	"github.com/mewmew/zelda"
+	"github.com/pkg/errors"
+)
+
+// optionFlags is the set of command line flags of relink options.
+type optionFlags struct {
+	// Command line flags.
+	fs *flag.FlagSet
+	// Relink options specified by command line flags.
+	opts zelda.Options
+	// Path to project file.
+	projectPath string
+	// Path to JSON file of exported symbols.
+	exportsPath string
+	// Path to JSON file of statically linked libraries.
+	staticLibsPath string
+	// Path to JSON file of __stdcall functions.
+	stdcallPath string
+	// Path to JSON file of hook libraries.
+	hooksPath string
+	// Path to JSON file of section rules.
+	sectionsPath string
+}
+
+// newOptionFlags returns a new set of relink option flags, registering the
+// -project flag with the given command line flags.
+func newOptionFlags(fs *flag.FlagSet) *optionFlags {
+	f := &optionFlags{
+		fs: fs,
+		opts: zelda.Options{
+			Base:      zelda.DefaultBase,
+			TraceArgs: zelda.DefaultTraceArgs,
+		},
+	}
+	fs.StringVar(&f.projectPath, "project", "", "path to JSON project file of relink options; overridden by command line flags")
+	return f
+}
+
+// addPatchFlags registers the command line flags of patches which modify
+// section contents directly.
+func (f *optionFlags) addPatchFlags() {
+	f.fs.Var(&f.opts.Ints, "int", `interrupt address ranges, optionally with expected content (e.g. "0x10-0x20,0x33-0x35=9090")`)
+	f.fs.Var(&f.opts.Nops, "nop", `nop address ranges, optionally with expected content (e.g. "0x10-0x20,0x33-0x35=sha1:HASH")`)
+	f.fs.Var(&f.opts.Replaces, "replace", `binary replacements by address, optionally with expected content (e.g. "0x10:DEAD,0x20:BEEF=C390")`)
+	f.fs.StringVar(&f.opts.PatchFile, "patch_file", "", `path to patch file of binary replacements by file offset (IPS, BPS, "cmp -l" output or patched PE file); differing bytes of patched PE files outside of section contents are skipped`)
+	f.fs.Var(&f.opts.PatchPriority, "patch_priority", `resolve overlapping patches by priority of patch kinds, in decreasing order (e.g. "replace,int,nop")`)
+	f.fs.BoolVar(&f.opts.ExplainPatches, "explain_patches", false, "output a listing of all patches on standard error")
+}
+
+// addLibFlags registers the command line flags of dynamic libraries.
+func (f *optionFlags) addLibFlags() {
+	f.fs.StringVar(&f.staticLibsPath, "static_libs", "", "path to JSON file of statically linked libraries")
+	f.fs.StringVar(&f.hooksPath, "hooks", "", "path to JSON file of hook libraries")
+	f.fs.StringVar(&f.stdcallPath, "stdcall", "", "path to JSON file of __stdcall functions and their stack argument sizes")
+	f.fs.StringVar(&f.opts.ProtoFile, "protos", "", "path to prototype file of imported functions, overriding the bundled Win32 prototypes; imported functions declared WINAPI by either are called through __stdcall thunks")
+}
+
+// addRelinkFlags registers the remaining command line flags of relink options.
+func (f *optionFlags) addRelinkFlags() {
+	f.fs.StringVar(&f.opts.Output, "o", "", "path to output NASM listing (default standard output)")
+	f.fs.Var(&f.opts.Base, "base", "base address of read-only segment")
+	f.fs.Var(&f.opts.Entry, "entry", "address of entry point")
+	f.fs.BoolVar(&f.opts.MapHeaders, "map_headers", false, "map the headers of the PE file into a read-only segment at the image base")
+	f.fs.Var(&f.opts.PermPolicy, "perm_policy", "access permission policy of sections (rwx_text, pe or wx)")
+	f.fs.Var(&f.opts.Writable, "writable", "comma-separated list of sections made writable (e.g. \".text,.rdata\")")
+	f.fs.StringVar(&f.sectionsPath, "sections", "", "path to JSON file of section rules (drop, noalloc, perm, rename and addr by PE section name); code and data of moved sections are not relocated")
+	f.fs.BoolVar(&f.opts.BindNow, "bind_now", false, "bind imported functions at load time; with -perm_policy wx, make .got.plt read-only after relocation")
+	f.fs.StringVar(&f.exportsPath, "export", "", "path to JSON file of exported symbols")
+	f.fs.Var(&f.opts.AsmPatches, "asm", `assembly patch by address range, which is required as instructions are encoded by nasm; may be repeated (e.g. "0x10-0x16: mov eax, 1; ret")`)
+	f.fs.BoolVar(&f.opts.Startup, "startup", false, "enter through a startup stub which installs a Windows TEB and PEB (fs:[0x18], fs:[0x30]) before jumping to the entry point")
+	f.fs.BoolVar(&f.opts.SEH, "seh", false, "dispatch faulting instructions to SEH exception handlers through the SEH runtime library ("+zelda.SEHLib+"); requires -startup")
+	f.fs.BoolVar(&f.opts.TraceImports, "trace_imports", false, "trace calls to imported functions on standard error")
+	f.fs.IntVar(&f.opts.TraceArgs, "trace_args", zelda.DefaultTraceArgs, "number of stack arguments to output when tracing calls to imported functions of unknown prototype")
+}
+
+// options returns the relink options and paths of PE files specified by the
+// parsed command line flags and arguments. If specified, the relink options of
+// the project file are used as a base, and individual fields are overridden by
+// command line flags. The PE file of the project file is used if no PE files
+// are specified as command line arguments.
+func (f *optionFlags) options() (zelda.Options, []string, error) {
+	opts := f.opts
+	pePaths := f.fs.Args()
+	// Parse JSON file of exported symbols.
+	if len(f.exportsPath) > 0 {
+		if err := jsonutil.ParseFile(f.exportsPath, &opts.Exports); err != nil {
+			return zelda.Options{}, nil, errors.WithStack(err)
+		}
+	}
+	// Parse JSON file of statically linked functions.
+	if len(f.staticLibsPath) > 0 {
+		if err := jsonutil.ParseFile(f.staticLibsPath, &opts.StaticLibs); err != nil {
+			return zelda.Options{}, nil, errors.WithStack(err)
+		}
+	}
+	// Parse JSON file of __stdcall functions.
+	if len(f.stdcallPath) > 0 {
+		if err := jsonutil.ParseFile(f.stdcallPath, &opts.StdcallFuncs); err != nil {
+			return zelda.Options{}, nil, errors.WithStack(err)
+		}
+	}
+	// Parse JSON file of hook libraries.
+	if len(f.hooksPath) > 0 {
+		if err := jsonutil.ParseFile(f.hooksPath, &opts.HookLibs); err != nil {
+			return zelda.Options{}, nil, errors.WithStack(err)
+		}
+	}
+	// Parse JSON file of section rules.
+	if len(f.sectionsPath) > 0 {
+		if err := jsonutil.ParseFile(f.sectionsPath, &opts.SectionRules); err != nil {
+			return zelda.Options{}, nil, errors.WithStack(err)
+		}
+	}
+	// Parse project file; command line flags override individual fields of the
+	// project file.
+	if len(f.projectPath) > 0 {
+		proj, err := zelda.ParseProject(f.projectPath)
+		if err != nil {
+			return zelda.Options{}, nil, errors.WithStack(err)
+		}
+		f.fs.Visit(func(flag *flag.Flag) {
+			overrideOption(&proj.Options, opts, flag.Name)
+		})
+		opts = proj.Options
+		if len(pePaths) == 0 && len(proj.Input) > 0 {
+			pePaths = []string{proj.Input}
+		}
+	}
+	return opts, pePaths, nil
+}
+
+// overrideOption overrides the relink option of dst corresponding to the given
+// command line flag with the relink option of src.
+func overrideOption(dst *zelda.Options, src zelda.Options, flagName string) {
+	switch flagName {
+	case "o":
+		dst.Output = src.Output
+	case "base":
+		dst.Base = src.Base
+	case "entry":
+		dst.Entry = src.Entry
+	case "map_headers":
+		dst.MapHeaders = src.MapHeaders
+	case "perm_policy":
+		dst.PermPolicy = src.PermPolicy
+	case "writable":
+		dst.Writable = src.Writable
+	case "bind_now":
+		dst.BindNow = src.BindNow
+	case "sections":
+		dst.SectionRules = src.SectionRules
+	case "export":
+		dst.Exports = src.Exports
+	case "int":
+		dst.Ints = src.Ints
+	case "nop":
+		dst.Nops = src.Nops
+	case "replace":
+		dst.Replaces = src.Replaces
+	case "patch_file":
+		dst.PatchFile = src.PatchFile
+	case "patch_priority":
+		dst.PatchPriority = src.PatchPriority
+	case "explain_patches":
+		dst.ExplainPatches = src.ExplainPatches
+	case "asm":
+		dst.AsmPatches = src.AsmPatches
+	case "static_libs":
+		dst.StaticLibs = src.StaticLibs
+	case "hooks":
+		dst.HookLibs = src.HookLibs
+	case "stdcall":
+		dst.StdcallFuncs = src.StdcallFuncs
+	case "protos":
+		dst.ProtoFile = src.ProtoFile
+	case "startup":
+		dst.Startup = src.Startup
+	case "seh":
+		dst.SEH = src.SEH
+	case "trace_imports":
+		dst.TraceImports = src.TraceImports
+	case "trace_args":
+		dst.TraceArgs = src.TraceArgs
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mewmew/zelda"
+)
+
+func TestOptionsProjectOverride(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zelda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	projectPath := filepath.Join(dir, "foo.json")
+	const project = `{
+	"version": 1,
+	"input": "foo.exe",
+	"output": "foo.asm",
+	"base": "0x200000",
+	"nops": ["0x401000-0x401002"],
+	"ints": ["0x401010-0x401011"],
+	"trace_args": 8
+}`
+	if err := ioutil.WriteFile(projectPath, []byte(project), 0644); err != nil {
+		t.Fatal(err)
+	}
+	golden := []struct {
+		name string
+		args []string
+		// Check the relink options and PE file paths.
+		check func(opts zelda.Options, pePaths []string) string
+	}{
+		{
+			name: "project",
+			args: []string{"-project", projectPath},
+			check: func(opts zelda.Options, pePaths []string) string {
+				switch {
+				case !reflect.DeepEqual(pePaths, []string{filepath.Join(dir, "foo.exe")}):
+					return "PE file of project file not used"
+				case opts.Output != filepath.Join(dir, "foo.asm"):
+					return "output path not resolved relative to project file"
+				case opts.Base != 0x200000 || opts.TraceArgs != 8:
+					return "options of project file overridden by default values of flags"
+				case len(opts.Nops) != 1 || len(opts.Ints) != 1:
+					return "patches of project file not used"
+				}
+				return ""
+			},
+		},
+		{
+			name: "flags override project",
+			args: []string{"-project", projectPath, "-base", "0x100000", "-nop", "0x402000-0x402004", "-o", "bar.asm", "bar.exe"},
+			check: func(opts zelda.Options, pePaths []string) string {
+				switch {
+				case !reflect.DeepEqual(pePaths, []string{"bar.exe"}):
+					return "PE file of command line not used"
+				case opts.Output != "bar.asm":
+					return "output path not overridden"
+				case opts.Base != 0x100000:
+					return "base address not overridden"
+				case len(opts.Nops) != 1 || opts.Nops[0].Start != 0x402000:
+					return "nop patches not overridden"
+				case len(opts.Ints) != 1 || opts.Ints[0].Start != 0x401010:
+					return "int patches of project file not kept"
+				case opts.TraceArgs != 8:
+					return "trace arguments of project file not kept"
+				}
+				return ""
+			},
+		},
+		{
+			name: "no project",
+			args: []string{"-nop", "0x402000-0x402004", "bar.exe"},
+			check: func(opts zelda.Options, pePaths []string) string {
+				switch {
+				case !reflect.DeepEqual(pePaths, []string{"bar.exe"}):
+					return "PE file of command line not used"
+				case opts.Base != zelda.DefaultBase || opts.TraceArgs != zelda.DefaultTraceArgs:
+					return "default options not used"
+				case len(opts.Nops) != 1:
+					return "nop patches not used"
+				}
+				return ""
+			},
+		},
+	}
+	for _, g := range golden {
+		fs := flag.NewFlagSet("relink", flag.ContinueOnError)
+		f := newOptionFlags(fs)
+		f.addRelinkFlags()
+		f.addPatchFlags()
+		f.addLibFlags()
+		if err := fs.Parse(g.args); err != nil {
+			t.Errorf("%s: unable to parse flags; %v", g.name, err)
+			continue
+		}
+		opts, pePaths, err := f.options()
+		if err != nil {
+			t.Errorf("%s: unable to get options; %v", g.name, err)
+			continue
+		}
+		if msg := g.check(opts, pePaths); len(msg) > 0 {
+			t.Errorf("%s: %s", g.name, msg)
+		}
+	}
+}
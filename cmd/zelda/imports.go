@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+
+	"github.com/mewmew/pe"
+	"github.com/mewmew/zelda"
+	"github.com/pkg/errors"
+)
+
+// importsCmd lists the functions required of the shared libraries of relinked
+// PE files, as must be implemented by shims.
+func importsCmd(args []string) error {
+	fs := newFlagSet("imports", "FILE.exe...", "List the functions required of the shared libraries of relinked PE files,\nas must be implemented by shims. The PE file of the project file is used if\nno PE files are specified.")
+	f := newOptionFlags(fs)
+	f.addLibFlags()
+	fs.Parse(args)
+	opts, pePaths, err := f.options()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(pePaths) == 0 {
+		fs.Usage()
+		return errUsage
+	}
+	for i, pePath := range pePaths {
+		if i > 0 {
+			fmt.Println()
+		}
+		if err := printImports(os.Stdout, pePath, opts); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// printImports prints the functions required of the shared libraries of the
+// given PE file, as relinked with the given options.
+func printImports(w io.Writer, pePath string, opts zelda.Options) error {
+	file, err := pe.ParseFile(pePath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	libs, err := zelda.CollectLibs(file, opts)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, lib := range libs {
+		fmt.Fprintf(w, "%s\n", lib.Filename)
+		tw := tabwriter.NewWriter(w, 1, 3, 2, ' ', 0)
+		for _, fn := range lib.Funcs {
+			callConv := "__cdecl"
+			if fn.ArgSize > 0 || (fn.Proto != nil && fn.Proto.Stdcall) {
+				// The __stdcall thunks of the .plt section call the __cdecl
+				// implementation of shims.
+				callConv = fmt.Sprintf("__stdcall (%d bytes of arguments)", fn.ArgSize)
+			}
+			proto := "unknown prototype"
+			if fn.Proto != nil {
+				proto = fn.Proto.String()
+			}
+			fmt.Fprintf(tw, "\t%s\t%s\t%s\n", fn.Name, callConv, proto)
+		}
+		if err := tw.Flush(); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/mewmew/pe/enum"
+	"github.com/mewmew/zelda"
+	"github.com/pkg/errors"
+)
+
+// infoCmd prints the sections, imports, exports and entry point of PE files.
+func infoCmd(args []string) error {
+	fs := newFlagSet("info", "FILE.exe...", "Print sections, imports, exports and entry point of PE files.")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+	for i, pePath := range fs.Args() {
+		if i > 0 {
+			fmt.Println()
+		}
+		if err := printInfo(os.Stdout, pePath); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// printInfo prints the sections, imports, exports and entry point of the given
+// PE file.
+//
+// The PE file is parsed using debug/pe, which unlike github.com/mewmew/pe
+// handles PE files containing export directories (e.g. DLLs).
+func printInfo(w io.Writer, pePath string) error {
+	file, err := pe.Open(pePath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	optHdr, ok := file.OptionalHeader.(*pe.OptionalHeader32)
+	if !ok {
+		return errors.Errorf("unsupported PE file %q; expected 32-bit optional header, got %T", pePath, file.OptionalHeader)
+	}
+	imageBase := zelda.Address(optHdr.ImageBase)
+	tw := tabwriter.NewWriter(w, 1, 3, 2, ' ', 0)
+	fmt.Fprintf(tw, "file:\t%s\n", pePath)
+	fmt.Fprintf(tw, "image base:\t%s\n", imageBase)
+	fmt.Fprintf(tw, "entry point:\t%s\n", imageBase+zelda.Address(optHdr.AddressOfEntryPoint))
+	if err := tw.Flush(); err != nil {
+		return errors.WithStack(err)
+	}
+	// Sections.
+	fmt.Fprintln(w, "\nsections:")
+	tw = tabwriter.NewWriter(w, 1, 3, 2, ' ', 0)
+	fmt.Fprintln(tw, "\tname\taddr\tvirtual size\traw size\tperm")
+	for _, sect := range file.Sections {
+		addr := imageBase + zelda.Address(sect.VirtualAddress)
+		perm := zelda.ParsePerm(enum.SectionFlag(sect.Characteristics))
+		fmt.Fprintf(tw, "\t%s\t%s\t0x%X\t0x%X\t%s\n", sect.Name, addr, sect.VirtualSize, sect.Size, perm)
+	}
+	if err := tw.Flush(); err != nil {
+		return errors.WithStack(err)
+	}
+	// Imports.
+	syms, err := file.ImportedSymbols()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	fmt.Fprintln(w, "\nimports:")
+	var dlls []string
+	dllFuncs := make(map[string][]string)
+	for _, sym := range syms {
+		// "<func>:<dll>"
+		pos := strings.LastIndex(sym, ":")
+		funcName, dll := sym[:pos], sym[pos+1:]
+		if _, ok := dllFuncs[dll]; !ok {
+			dlls = append(dlls, dll)
+		}
+		dllFuncs[dll] = append(dllFuncs[dll], funcName)
+	}
+	for _, dll := range dlls {
+		fmt.Fprintf(w, "  %s\n", dll)
+		for _, funcName := range dllFuncs[dll] {
+			fmt.Fprintf(w, "    %s\n", funcName)
+		}
+	}
+	// Exports.
+	exports, err := peExports(file, optHdr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	fmt.Fprintln(w, "\nexports:")
+	tw = tabwriter.NewWriter(w, 1, 3, 2, ' ', 0)
+	if len(exports) > 0 {
+		fmt.Fprintln(tw, "\tordinal\taddr\tname")
+	}
+	for _, export := range exports {
+		addr := (imageBase + zelda.Address(export.RelAddr)).String()
+		if len(export.Forwarder) > 0 {
+			addr = "-> " + export.Forwarder
+		}
+		fmt.Fprintf(tw, "\t%d\t%s\t%s\n", export.Ordinal, addr, export.Name)
+	}
+	if err := tw.Flush(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// peExport is an exported symbol of a PE file.
+type peExport struct {
+	// Ordinal of exported symbol.
+	Ordinal uint32
+	// (optional) Symbol name.
+	Name string
+	// Relative address of exported symbol.
+	RelAddr uint32
+	// (optional) Forwarded symbol (e.g. "NTDLL.RtlAllocateHeap").
+	Forwarder string
+}
+
+// peExports returns the exported symbols of the given PE file, sorted by
+// ordinal.
+func peExports(file *pe.File, optHdr *pe.OptionalHeader32) ([]peExport, error) {
+	if len(optHdr.DataDirectory) <= pe.IMAGE_DIRECTORY_ENTRY_EXPORT {
+		return nil, nil
+	}
+	dataDir := optHdr.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_EXPORT]
+	if dataDir.VirtualAddress == 0 {
+		return nil, nil
+	}
+	// Export directory.
+	var exportDir struct {
+		Characteristics     uint32
+		TimeDateStamp       uint32
+		MajorVersion        uint16
+		MinorVersion        uint16
+		NameRelAddr         uint32
+		OrdinalBase         uint32
+		NFuncs              uint32
+		NNames              uint32
+		FuncsRelAddr        uint32
+		NamesRelAddr        uint32
+		NameOrdinalsRelAddr uint32
+	}
+	buf, err := readRelAddr(file, dataDir.VirtualAddress, uint32(binary.Size(exportDir)))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &exportDir); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Export address table.
+	funcs := make([]uint32, exportDir.NFuncs)
+	if err := readTable(file, exportDir.FuncsRelAddr, funcs); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Export name pointer and ordinal tables.
+	names := make([]uint32, exportDir.NNames)
+	if err := readTable(file, exportDir.NamesRelAddr, names); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	nameOrdinals := make([]uint16, exportDir.NNames)
+	if err := readTable(file, exportDir.NameOrdinalsRelAddr, nameOrdinals); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	funcNames := make(map[uint16]string)
+	for i, nameRelAddr := range names {
+		name, err := readCString(file, nameRelAddr)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		funcNames[nameOrdinals[i]] = name
+	}
+	var exports []peExport
+	for i, relAddr := range funcs {
+		if relAddr == 0 {
+			// Unused ordinal.
+			continue
+		}
+		export := peExport{
+			Ordinal: exportDir.OrdinalBase + uint32(i),
+			Name:    funcNames[uint16(i)],
+			RelAddr: relAddr,
+		}
+		// Forwarded symbols point into the export directory.
+		if dataDir.VirtualAddress <= relAddr && relAddr < dataDir.VirtualAddress+dataDir.Size {
+			forwarder, err := readCString(file, relAddr)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			export.Forwarder = forwarder
+		}
+		exports = append(exports, export)
+	}
+	sort.Slice(exports, func(i, j int) bool {
+		return exports[i].Ordinal < exports[j].Ordinal
+	})
+	return exports, nil
+}
+
+// readTable reads the table at the given relative address of the PE file into
+// the slice v of fixed-size values.
+func readTable(file *pe.File, relAddr uint32, v interface{}) error {
+	buf, err := readRelAddr(file, relAddr, uint32(binary.Size(v)))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, v); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// readRelAddr reads n bytes at the given relative address of the PE file.
+func readRelAddr(file *pe.File, relAddr, n uint32) ([]byte, error) {
+	for _, sect := range file.Sections {
+		if sect.VirtualAddress <= relAddr && relAddr+n <= sect.VirtualAddress+sect.Size {
+			buf := make([]byte, n)
+			if _, err := sect.ReadAt(buf, int64(relAddr-sect.VirtualAddress)); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			return buf, nil
+		}
+	}
+	return nil, errors.Errorf("unable to locate section contents of relative address 0x%X (%d bytes)", relAddr, n)
+}
+
+// readCString reads the NULL-terminated string at the given relative address of
+// the PE file.
+func readCString(file *pe.File, relAddr uint32) (string, error) {
+	for _, sect := range file.Sections {
+		if sect.VirtualAddress <= relAddr && relAddr < sect.VirtualAddress+sect.Size {
+			data, err := sect.Data()
+			if err != nil {
+				return "", errors.WithStack(err)
+			}
+			data = data[relAddr-sect.VirtualAddress:]
+			if pos := bytes.IndexByte(data, 0); pos != -1 {
+				data = data[:pos]
+			}
+			return string(data), nil
+		}
+	}
+	return "", errors.Errorf("unable to locate section contents of relative address 0x%X", relAddr)
+}
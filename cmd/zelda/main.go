@@ -3,494 +3,413 @@ package main
 
 import (
 	"bytes"
-	"debug/elf"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
-	"sort"
-	"strings"
+	"os/exec"
+	"path/filepath"
 
-	"github.com/mewkiz/pkg/jsonutil"
 	"github.com/mewkiz/pkg/pathutil"
-	"github.com/mewmew/pe"
+	"github.com/mewmew/zelda"
 	"github.com/pkg/errors"
 )
 
-func usage() {
-	fmt.Fprintln(os.Stderr, "Usage: zelda [OPTION]... FILE.exe...")
-	flag.PrintDefaults()
+// command is a subcommand of zelda.
+type command struct {
+	// Command name.
+	name string
+	// Short description of command.
+	desc string
+	// run runs the command with the given command line arguments.
+	run func(args []string) error
 }
 
-func main() {
-	// Parse command line arguments.
-	var (
-		// Address of entry point.
-		entry Address
-		// Path to JSON file of exported symbols.
-		exportsPath string
-		// interrupt address ranges.
-		ints AddrRanges
-		// nop address ranges.
-		nops AddrRanges
-		// binary replacements by address.
-		replaces Replacements
-		// Path to JSON file of statically linked libraries.
-		staticLibsPath string
-	)
-	flag.Usage = usage
-	flag.Var(&entry, "entry", "address of entry point")
-	flag.StringVar(&exportsPath, "export", "", "path to JSON file of exported symbols")
-	flag.Var(&ints, "int", `interrupt address ranges (e.g. "0x10-0x20,0x33-0x37")`)
-	flag.Var(&nops, "nop", `nop address ranges (e.g. "0x10-0x20,0x33-0x37")`)
-	flag.Var(&replaces, "replace", `binary replacements by address (e.g. "0x10:DEAD,0x20:BEEF")`)
-	flag.StringVar(&staticLibsPath, "static_libs", "", "path to JSON file of statically linked libraries")
-	flag.Parse()
+// commands is the list of subcommands of zelda.
+var commands []command
 
-	// Parse JSON file of exported symbols.
-	var exports []Export
-	if len(exportsPath) > 0 {
-		if err := jsonutil.ParseFile(exportsPath, &exports); err != nil {
-			log.Fatalf("%+v", err)
-		}
-	}
-	// Parse JSON file of statically linked functions.
-	var staticLibs []StaticLib
-	if len(staticLibsPath) > 0 {
-		if err := jsonutil.ParseFile(staticLibsPath, &staticLibs); err != nil {
-			log.Fatalf("%+v", err)
-		}
-	}
-	for _, pePath := range flag.Args() {
-		if err := relink(pePath, entry, ints, nops, replaces, exports, staticLibs); err != nil {
-			log.Fatalf("%+v", err)
-		}
+func init() {
+	commands = []command{
+		{name: "relink", desc: "relink PE files into NASM listings of ELF files (default command)", run: relinkCmd},
+		{name: "info", desc: "print sections, imports, exports and entry point of PE files", run: infoCmd},
+		{name: "imports", desc: "list the functions required of shared libraries (shims)", run: importsCmd},
+		{name: "shims", desc: "generate skeleton shims of the imported libraries of PE files", run: shimsCmd},
+		{name: "seh", desc: "generate the SEH runtime library of relinked executables", run: sehCmd},
+		{name: "patch", desc: "apply patches to a PE file, producing a patched PE file", run: patchCmd},
+		{name: "verify", desc: "check the structure of ELF files produced from relinked PE files", run: verifyCmd},
+		{name: "init", desc: "write skeleton project file of PE file", run: initCmd},
 	}
 }
 
-// relink relinks the given PE file into a corresponding ELF file. If specified,
-// the nop address ranges are nop'ed out, and the statically linked libraries
-// are replaced with dynamic libraries.
-func relink(pePath string, entry Address, ints, nops AddrRanges, replaces Replacements, exports []Export, staticLibs []StaticLib) error {
-	// Parse PE file.
-	file, err := pe.ParseFile(pePath)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	// Parse sections.
-	sects := parseSects(file)
-	// Parse imported libraries.
-	libs := parseImports(file)
-	// Add dynamic libraries of statically linked libraries.
-	for _, staticLib := range staticLibs {
-		lib := Library{
-			Name:     libName(staticLib.Filename),
-			Filename: staticLib.Filename,
-		}
-		present := make(map[string]bool)
-		for _, fn := range staticLib.Funcs {
-			if _, ok := present[fn.Name]; ok {
-				// skip duplicate function names
-				continue
-			}
-			present[fn.Name] = true
-			lib.Funcs = append(lib.Funcs, fn.Name)
-		}
-		libs = append(libs, lib)
-	}
-	// TODO: add command line option to add extra import libraries.
+func usage() {
+	const use = `
+Usage:
+	zelda COMMAND [OPTION]... [ARG]...
+	zelda [OPTION]... FILE.exe...
 
-	// ___ [ Read-only segment ] ___
-	// Output header of read-only segment.
-	out := &bytes.Buffer{}
-	// TODO: make base address configurable from command line.
-	const base = 0x00300000 // use 0x003XXXXX to prevent conflict with 0x004XXXXX
-	if err := dumpRSegPre(out, base); err != nil {
-		return errors.WithStack(err)
-	}
-	// Output ELF file header.
-	if entry == 0 {
-		entry = Address(file.OptHdr.ImageBase) + Address(file.OptHdr.EntryRelAddr)
-	}
-	isSharedLib := len(exports) > 0
-	if err := dumpFileHdr(out, entry, isSharedLib); err != nil {
-		return errors.WithStack(err)
-	}
-	// Get ELF program headers for the sections.
-	progHdrs := elfProgHdrs(sects)
-	// Output ELF program headers.
-	if err := dumpProgHdrs(out, progHdrs); err != nil {
-		return errors.WithStack(err)
+Commands:
+`
+	fmt.Fprint(os.Stderr, use[1:])
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "\t%-8s%s\n", cmd.name, cmd.desc)
 	}
-	// Output sections.
-	// === [ Sections ] ===
-	// Output sections header.
-	const sectPre = "; === [ Sections ] =============================================================\n\n"
-	if _, err := out.WriteString(sectPre); err != nil {
-		return errors.WithStack(err)
+	fmt.Fprintln(os.Stderr, "\nRun \"zelda COMMAND -help\" for the flags of each command.")
+}
+
+// newFlagSet returns a new set of command line flags of the given command, with
+// help text based on the command arguments and description.
+func newFlagSet(name, args, desc string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: zelda %s [OPTION]... %s\n\n%s\n\nFlags:\n", name, args, desc)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	name, args := os.Args[1], os.Args[2:]
+	switch name {
+	case "help", "-h", "-help", "--help":
+		usage()
+		return
+	}
+	run := relinkCmd
+	found := false
+	for _, cmd := range commands {
+		if cmd.name == name {
+			run = cmd.run
+			found = true
+			break
+		}
 	}
-	// .interp
-	if err := dumpInterpSect(out); err != nil {
-		return errors.WithStack(err)
+	if !found {
+		// Relink PE files by default (e.g. "zelda FILE.exe").
+		args = os.Args[1:]
 	}
-	if isSharedLib {
-		// .hash
-		nglobals := len(exports)
-		for _, lib := range libs {
-			nglobals += len(lib.Funcs)
+	if err := run(args); err != nil {
+		if errors.Cause(err) == errUsage {
+			// Usage has been printed by the command.
+			os.Exit(2)
 		}
-		if err := dumpHashSect(out, nglobals); err != nil {
-			return errors.WithStack(err)
+		if _, ok := errors.Cause(err).(errFailed); ok {
+			// Failures have been reported by the command.
+			os.Exit(1)
 		}
+		log.Fatalf("%+v", err)
 	}
-	// .dynstr
-	if err := dumpDynstrSect(out, libs, exports); err != nil {
-		return errors.WithStack(err)
-	}
-	// .dynsym
-	if err := dumpDynsymSect(out, libs, exports); err != nil {
-		return errors.WithStack(err)
-	}
-	// .rel.plt
-	if err := dumpRelPltSect(out, libs); err != nil {
-		return errors.WithStack(err)
-	}
-	// Output footer of read-only segment.
-	if err := dumpRSegPost(out); err != nil {
-		return errors.WithStack(err)
-	}
-	// ___ [/ Read-only segment ] ___
+}
 
-	// ___ [ Read-write segment ] ___
-	// Output header of read-write segment.
-	if err := dumpRWSegPre(out); err != nil {
-		return errors.WithStack(err)
-	}
-	// .dynamic
-	if err := dumpDynamicSect(out, libs, exports); err != nil {
-		return errors.WithStack(err)
-	}
-	// .got.plt
-	if err := dumpGotPltSect(out, libs); err != nil {
-		return errors.WithStack(err)
-	}
-	// Output footer of read-write segment.
-	if err := dumpRWSegPost(out); err != nil {
-		return errors.WithStack(err)
-	}
-	// ___ [/ Read-write segment ] ___
+// errUsage is returned by commands invoked with invalid command line arguments,
+// after printing their usage.
+var errUsage = errors.New("invalid command line arguments")
 
-	// ___ [ Executable segment ] ___
-	// Output header of executable segment.
-	if err := dumpXSegPre(out); err != nil {
-		return errors.WithStack(err)
-	}
-	// .plt
-	if err := dumpPltSect(out, libs); err != nil {
-		return errors.WithStack(err)
-	}
-	// Output footer of executable segment.
-	if err := dumpXSegPost(out); err != nil {
-		return errors.WithStack(err)
-	}
-	// ___ [/ Executable segment ] ___
+// errFailed is returned by commands after reporting the failure of n of their
+// jobs.
+type errFailed struct {
+	// Number of failed jobs.
+	n int
+}
+
+// Error returns the error message of the failed jobs.
+func (e errFailed) Error() string {
+	return fmt.Sprintf("%d jobs failed", e.n)
+}
 
-	// Output sections of PE file.
-	prevSeg := "x_seg"
-	var fs []func(w io.Writer, addr Address, buf []byte) (int, error)
-	libImpsPrinter, err := getLibImpsPrinter(file)
+// relinkCmd relinks PE files into NASM listings of ELF files.
+func relinkCmd(args []string) error {
+	fs := newFlagSet("relink", "FILE.exe...", "Relink PE files into NASM listings of ELF files. The PE file of the\nproject file is relinked if no PE files are specified.")
+	var (
+		// Output directory of batch relinking.
+		outDir string
+		// Assemble NASM listings into ELF files.
+		assemble bool
+		// Write JSON manifests of relinked PE files.
+		manifest bool
+		// Number of PE files to relink in parallel.
+		njobs int
+		// Directory of templates overriding the embedded templates.
+		templatesDir string
+		// Report failures with stack traces.
+		verbose bool
+	)
+	fs.BoolVar(&verbose, "v", false, "verbose output; report failures with stack traces")
+	fs.IntVar(&njobs, "j", 1, "number of PE files to relink in parallel")
+	fs.StringVar(&templatesDir, "templates", "", "directory of template files (*.tmpl) overriding the embedded templates of the same name")
+	fs.StringVar(&outDir, "outdir", "", "output directory of NASM listings (foo.exe -> DIR/foo.asm) and assembled ELF files (DIR/foo)")
+	fs.BoolVar(&assemble, "assemble", false, "assemble NASM listings into ELF files using nasm (foo.asm -> foo)")
+	fs.BoolVar(&manifest, "manifest", false, "write JSON manifests of segments, .plt and .got.plt entries, patches and exports alongside NASM listings (foo.asm -> foo.manifest.json)")
+	f := newOptionFlags(fs)
+	f.addRelinkFlags()
+	f.addPatchFlags()
+	f.addLibFlags()
+	fs.Parse(args)
+	opts, pePaths, err := f.options()
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	fs = append(fs, libImpsPrinter)
-	staticLibsPrinter, err := getStaticLibsPrinter(staticLibs)
-	if err != nil {
-		return errors.WithStack(err)
+	if len(pePaths) == 0 {
+		fs.Usage()
+		return errUsage
 	}
-	fs = append(fs, staticLibsPrinter)
-	for _, sect := range sects {
-		nopSect(sect, nops)
-		intSect(sect, ints)
-		replaceSect(sect, replaces)
-		content, err := genSectContent(sect, fs...)
+	if len(outDir) > 0 {
+		fs.Visit(func(flag *flag.Flag) {
+			if flag.Name == "o" {
+				err = errors.New("unable to combine -o with -outdir; the output path of each PE file is determined by the output directory")
+			}
+		})
 		if err != nil {
+			return err
+		}
+	}
+	if njobs < 1 {
+		return errors.Errorf("invalid number of parallel jobs; expected >= 1, got %d", njobs)
+	}
+	if len(templatesDir) > 0 {
+		if err := zelda.OverrideTemplates(templatesDir); err != nil {
 			return errors.WithStack(err)
 		}
-		if err := dumpSect(out, sect, prevSeg, content); err != nil {
+	}
+	if len(outDir) > 0 {
+		if err := os.MkdirAll(outDir, 0755); err != nil {
 			return errors.WithStack(err)
 		}
-		prevSeg = nasmIdent(sect.Name)
+	} else {
+		if len(pePaths) > 1 {
+			return errors.Errorf("output directory required to relink %d PE files; use -outdir", len(pePaths))
+		}
+		if assemble && len(opts.Output) == 0 {
+			return errors.New("output path required to assemble NASM listing; use -o or -outdir")
+		}
+		if manifest && len(opts.Output) == 0 {
+			return errors.New("output path required to write manifest; use -o or -outdir")
+		}
 	}
-
-	// .shstrtab section.
-	if err := dumpShstrtabSect(out, prevSeg, sects); err != nil {
-		return errors.WithStack(err)
+	// Output paths of batch relinking, mapped from PE file path.
+	outputs := make(map[string]string)
+	if len(outDir) > 0 {
+		// PE file paths, mapped from output path.
+		inputs := make(map[string]string)
+		for _, pePath := range pePaths {
+			output := filepath.Join(outDir, pathutil.FileName(pePath)+".asm")
+			if prev, ok := inputs[output]; ok {
+				return errors.Errorf("PE files %q and %q have the same output path %q", prev, pePath, output)
+			}
+			inputs[output] = pePath
+			outputs[pePath] = output
+		}
 	}
-
-	// Output sections footer.
-	const sectPost = "; === [/ Sections ] ============================================================\n\n"
-	if _, err := out.WriteString(sectPost); err != nil {
-		return errors.WithStack(err)
+	// Relink PE files in parallel, reporting failures without aborting the
+	// batch. The logs of relink jobs are output in order of the PE files.
+	jobs := make([]*relinkJob, len(pePaths))
+	for i, pePath := range pePaths {
+		job := &relinkJob{
+			pePath:   pePath,
+			opts:     opts,
+			assemble: assemble,
+			manifest: manifest,
+			done:     make(chan struct{}),
+		}
+		if len(outDir) > 0 {
+			job.opts.Output = outputs[pePath]
+		}
+		if len(pePaths) > 1 {
+			job.logPrefix = filepath.Base(pePath) + ": "
+		}
+		jobs[i] = job
 	}
-	// === [/ Sections ] ===
-
-	// === [ Section headers ] ===
-	hasGlobal := len(exports) > 0 || len(libs) > 0
-	if err := dumpSectHdrs(out, sects, hasGlobal); err != nil {
+	failed, err := runRelinkJobs(os.Stderr, jobs, njobs, verbose)
+	if err != nil {
 		return errors.WithStack(err)
 	}
-	// === [/ Section headers ] ===
-
-	fmt.Println(out.String())
+	if len(jobs) > 1 {
+		log.Printf("relinked %d of %d PE files (%d failed)", len(jobs)-failed, len(jobs), failed)
+	}
+	if failed > 0 {
+		return errFailed{n: failed}
+	}
 	return nil
 }
 
-// getStaticLibsPrinter returns a pretty-printed for statically linked library.
-func getStaticLibsPrinter(staticLibs []StaticLib) (func(w io.Writer, addr Address, buf []byte) (int, error), error) {
-	f := func(w io.Writer, addr Address, buf []byte) (int, error) {
-		for _, staticLib := range staticLibs {
-			for _, fn := range staticLib.Funcs {
-				const injectSize = 5
-				if fn.Addr == addr {
-					staticFuncName := fmt.Sprintf("%s_%08x", fn.Name, uint64(addr))
-					if _, err := fmt.Fprintf(w, "  .%s:\n", staticFuncName); err != nil {
-						return 0, errors.WithStack(err)
-					}
-					if _, err := fmt.Fprintf(w, "\tjmp     plt.%s\n", fn.Name); err != nil {
-						return 0, errors.WithStack(err)
-					}
-					if _, err := fmt.Fprintf(w, "  times (%d - ($ - .%s)) int3\n", injectSize, staticFuncName); err != nil {
-						return 0, errors.WithStack(err)
-					}
-					return injectSize, nil
-				}
+// runRelinkJobs runs the given relink jobs using njobs parallel workers, and
+// returns the number of failed jobs. The logs and failures of jobs are written
+// to w in order of the jobs, as each job finishes.
+func runRelinkJobs(w io.Writer, jobs []*relinkJob, njobs int, verbose bool) (int, error) {
+	queue := make(chan *relinkJob)
+	for i := 0; i < njobs && i < len(jobs); i++ {
+		go func() {
+			for job := range queue {
+				job.run()
+				close(job.done)
 			}
-		}
-		return 0, nil
+		}()
 	}
-	return f, nil
-}
-
-// getLibImpsPrinter returns a pretty-printed for library imports.
-func getLibImpsPrinter(file *pe.File) (func(w io.Writer, addr Address, buf []byte) (int, error), error) {
-	// === [ Library imports ] ===
-	libImpsBuf := &bytes.Buffer{}
-	// Ensure that we only include libraries present in the original PE file, and
-	// not any added libraries; as these will be pretty-printed to their original
-	// offset in the .idata section of the PE.
-	impLibs := parseImports(file)
-	// Sort import libraries by their occurrence in the PE file.
-	libRelAddr := make(map[string]uint32)
-	for _, imp := range file.Imps {
-		baseName := libName(imp.ImpDir.Name)
-		libRelAddr[baseName] = imp.ImpDir.IATRelAddr
-	}
-	less := func(i, j int) bool {
-		// Ensure that libraries present in the original PE file are sorted first, as their offset
-		iv, ok1 := libRelAddr[impLibs[i].Name]
-		if !ok1 {
-			panic(fmt.Errorf("invalid relative import library %q, not present in original PE file", impLibs[i].Name))
+	go func() {
+		for _, job := range jobs {
+			queue <- job
 		}
-		jv, ok2 := libRelAddr[impLibs[j].Name]
-		if !ok2 {
-			panic(fmt.Errorf("invalid relative import library %q, not present in original PE file", impLibs[j].Name))
-		}
-		return iv < jv
-	}
-	sort.Slice(impLibs, less)
-	for _, impLib := range impLibs {
-		if err := dumpLibImps(libImpsBuf, impLib); err != nil {
-			return nil, errors.WithStack(err)
+		close(queue)
+	}()
+	logger := log.New(w, "", log.LstdFlags)
+	failed := 0
+	for _, job := range jobs {
+		<-job.done
+		if _, err := w.Write(job.log.Bytes()); err != nil {
+			return failed, errors.WithStack(err)
 		}
-	}
-	// Relative address of first import entity.
-	var minIATRelAddr Address
-	for _, relAddr := range libRelAddr {
-		iatRelAddr := Address(relAddr)
-		if minIATRelAddr == 0 || iatRelAddr < minIATRelAddr {
-			minIATRelAddr = iatRelAddr
-		}
-	}
-	libImpsAddr := Address(file.OptHdr.ImageBase) + minIATRelAddr
-	libImpsSize := 0
-	for _, impLib := range impLibs {
-		// 4 bytes per function and a terminating NULL import entry.
-		libImpsSize += 4 * (len(impLib.Funcs) + 1)
-	}
-	// === [/ Library imports ] ===
-	f := func(w io.Writer, addr Address, buf []byte) (int, error) {
-		if addr == libImpsAddr {
-			if _, err := libImpsBuf.WriteTo(w); err != nil {
-				return 0, errors.WithStack(err)
+		if job.err != nil {
+			if verbose {
+				logger.Printf("unable to relink %q: %+v", job.pePath, job.err)
+			} else {
+				logger.Printf("unable to relink %q: %v", job.pePath, job.err)
 			}
-			return libImpsSize, nil
+			failed++
 		}
-		return 0, nil
 	}
-	return f, nil
+	return failed, nil
 }
 
-// parseSects parses the sections of the given PE file into a unified format.
-func parseSects(file *pe.File) []*Section {
-	var sects []*Section
-	for _, sectHdr := range file.SectHdrs {
-		start := sectHdr.DataOffset
-		end := start + sectHdr.DataSize
-		data := file.Content[start:end]
-		addr := Address(file.OptHdr.ImageBase) + Address(sectHdr.RelAddr)
-		perm := parsePerm(sectHdr.Flags)
-		if sectHdr.Name == ".text" {
-			// NOTE: we make the .text segment rwx to support binary
-			// instrumentation at runtime. Viewer discression is adviced. Don't do
-			// this at home :)
-			perm |= PermW
-		}
-		sect := &Section{
-			Name: sectHdr.Name,
-			Data: data,
-			Size: int64(sectHdr.VirtualSize),
-			Addr: addr,
-			Perm: perm,
-		}
-		sects = append(sects, sect)
-	}
-	return sects
+// relinkJob is a job relinking a PE file.
+type relinkJob struct {
+	// Path to PE file.
+	pePath string
+	// Relink options.
+	opts zelda.Options
+	// Assemble NASM listing into ELF file.
+	assemble bool
+	// Write JSON manifest of relinked PE file.
+	manifest bool
+	// Prefix of log messages.
+	logPrefix string
+	// Log output of job.
+	log bytes.Buffer
+	// Output files created by job; removed if the job fails.
+	outputs []string
+	// Error of job; or nil on success.
+	err error
+	// done is closed when the job has finished.
+	done chan struct{}
 }
 
-// elfProgHdrs returns the ELF program headers corresponding to the given
-// sections. The interpreter and dynamic program headers are always included.
-func elfProgHdrs(sects []*Section) []ProgHeader {
-	var progHdrs []ProgHeader
-	// Add interpreter program header.
-	interpProgHdr := ProgHeader{
-		Title: "Interpreter program header",
-		Type:  elf.PT_INTERP.String(),
-		Name:  "interp",
-		Flags: elf.PF_R.String(),
-		Align: fmt.Sprintf("0x%X", 1),
-	}
-	progHdrs = append(progHdrs, interpProgHdr)
-	// Add dynamic program header.
-	dynamicProgHdr := ProgHeader{
-		Title: "Dynamic array program header",
-		Type:  elf.PT_DYNAMIC.String(),
-		Name:  "dynamic",
-		Flags: elf.PF_R.String(),
-		Align: "dynamic_align",
-	}
-	progHdrs = append(progHdrs, dynamicProgHdr)
-	// Add read-only segment program header.
-	rSegProgHdr := ProgHeader{
-		Title: "Read-only segment program header",
-		Type:  elf.PT_LOAD.String(),
-		Name:  "r_seg",
-		Flags: elf.PF_R.String(),
-		Align: "PAGE",
-	}
-	progHdrs = append(progHdrs, rSegProgHdr)
-	// Add read-write segment program header.
-	rwSegProgHdr := ProgHeader{
-		Title: "Read-write segment program header",
-		Type:  elf.PT_LOAD.String(),
-		Name:  "rw_seg",
-		Flags: ProgFlagString(elf.PF_R | elf.PF_W),
-		Align: "PAGE",
-	}
-	progHdrs = append(progHdrs, rwSegProgHdr)
-	// Add executable segment program header.
-	xSegProgHdr := ProgHeader{
-		Title: "Executable segment program header",
-		Type:  elf.PT_LOAD.String(),
-		Name:  "x_seg",
-		Flags: ProgFlagString(elf.PF_R | elf.PF_X),
-		Align: "PAGE",
-	}
-	progHdrs = append(progHdrs, xSegProgHdr)
-	// Add section program headers.
-	for _, sect := range sects {
-		title := fmt.Sprintf("%s segment program header", sect.Name)
-		name := nasmIdent(sect.Name)
-		flags := elfProgFlag(sect.Perm)
-		progHdr := ProgHeader{
-			Title: title,
-			Type:  elf.PT_LOAD.String(),
-			Name:  name,
-			Flags: ProgFlagString(flags),
-			Align: "PAGE",
+// run relinks the PE file of the job, and optionally assembles its NASM
+// listing and writes its manifest. Panics (e.g. of PE files not supported by
+// the PE parser) are reported as the failure of the job, and the output files
+// of failed jobs are removed.
+func (job *relinkJob) run() {
+	defer func() {
+		if e := recover(); e != nil {
+			job.err = errors.Errorf("panic: %v", e)
 		}
-		progHdrs = append(progHdrs, progHdr)
-	}
-	return progHdrs
-}
-
-// parseImports parses the imported libraries of the given PE file into a
-// unified format.
-func parseImports(file *pe.File) []Library {
-	var libs []Library
-	for _, imp := range file.Imps {
-		baseName := libName(imp.ImpDir.Name)
-		filename := baseName + ".so"
-		lib := Library{
-			Name:     baseName,
-			Filename: filename,
+		if job.err != nil {
+			for _, output := range job.outputs {
+				if err := os.Remove(output); err != nil && !os.IsNotExist(err) {
+					job.logf("unable to remove output file %q: %v", output, err)
+				}
+			}
 		}
-		for _, iat := range imp.IATs {
-			var funcName string
-			if iat.IsOrdinal {
-				funcName = fmt.Sprintf("%s_ordinal_%d", baseName, iat.Ordinal)
-			} else {
-				funcName = iat.NameEntry.Name
+	}()
+	r := zelda.NewRelinker(job.opts)
+	r.Logger = log.New(&job.log, job.logPrefix, log.LstdFlags)
+	out := &bytes.Buffer{}
+	res, err := r.Relink(out, job.pePath)
+	if err != nil {
+		job.err = err
+		return
+	}
+	// Write NASM listing to output file or standard output.
+	if len(job.opts.Output) > 0 {
+		job.outputs = append(job.outputs, job.opts.Output)
+		if err := ioutil.WriteFile(job.opts.Output, out.Bytes(), 0644); err != nil {
+			job.err = errors.WithStack(err)
+			return
+		}
+	} else if _, err := os.Stdout.Write(out.Bytes()); err != nil {
+		job.err = errors.WithStack(err)
+		return
+	}
+	var m *zelda.Manifest
+	if job.manifest {
+		m = zelda.NewManifest(job.pePath, job.opts.Output, res)
+	}
+	if job.assemble {
+		elfPath := pathutil.TrimExt(job.opts.Output)
+		job.outputs = append(job.outputs, elfPath)
+		if err := assembleListing(job.opts.Output, elfPath); err != nil {
+			job.err = errors.Wrapf(err, "unable to assemble %q", job.opts.Output)
+			return
+		}
+		if m != nil {
+			if err := m.ReadELF(elfPath); err != nil {
+				job.err = errors.WithStack(err)
+				return
 			}
-			lib.Funcs = append(lib.Funcs, funcName)
 		}
-		libs = append(libs, lib)
 	}
-	return libs
+	if m != nil {
+		manifestPath := pathutil.TrimExt(job.opts.Output) + ".manifest.json"
+		job.outputs = append(job.outputs, manifestPath)
+		if err := writeManifest(manifestPath, m); err != nil {
+			job.err = errors.WithStack(err)
+		}
+	}
 }
 
-// nopSect nops the parts of the section contained within the given address
-// ranges.
-func nopSect(sect *Section, nops AddrRanges) {
-	b := byte(0x00) // 0 byte.
-	if sect.Perm&PermX != 0 {
-		b = byte(0x90) // NOP instruction
-	}
-	for _, nop := range nops {
-		sect.fill(nop, b)
-	}
+// logf appends the formatted message to the log output of the job.
+func (job *relinkJob) logf(format string, args ...interface{}) {
+	log.New(&job.log, job.logPrefix, log.LstdFlags).Printf(format, args...)
 }
 
-// intSect fills the parts of the section contained within the given address
-// ranges with interrupt instructions.
-func intSect(sect *Section, ints AddrRanges) {
-	if sect.Perm&PermX != 0 {
-		b := byte(0xCC) // INT3 instruction
-		for _, i := range ints {
-			sect.fill(i, b)
-		}
+// writeManifest writes the given manifest to the specified JSON file.
+func writeManifest(manifestPath string, m *zelda.Manifest) error {
+	f, err := os.Create(manifestPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := m.Write(f); err != nil {
+		f.Close()
+		return errors.WithStack(err)
 	}
+	if err := f.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
 }
 
-// replaceSect replaces the parts of the section specified by the given binary
-// replacements.
-func replaceSect(sect *Section, replaces Replacements) {
-	for _, replace := range replaces {
-		sect.replace(replace.Addr, replace.Buf)
+// assembleListing assembles the given NASM listing into an executable ELF file,
+// using nasm.
+func assembleListing(asmPath, elfPath string) error {
+	cmd := exec.Command("nasm", "-f", "bin", "-o", elfPath, asmPath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Errorf("nasm failed: %v\n%s", err, out)
+	}
+	if err := os.Chmod(elfPath, 0755); err != nil {
+		return errors.WithStack(err)
 	}
+	return nil
 }
 
-// libName returns the basename without extension of the given library file
-// name.
-func libName(filename string) string {
-	filename = strings.ToLower(filename)
-	// libc.so.6 -> libc
-	for {
-		// Trim multiple extensions, as used by symlinks.
-		s := pathutil.TrimExt(filename)
-		if s == filename {
-			return s
-		}
-		filename = s
+// initCmd writes a skeleton project file of a PE file.
+func initCmd(args []string) error {
+	fs := newFlagSet("init", "FILE.exe", "Write skeleton project file of PE file.")
+	var projectPath string
+	fs.StringVar(&projectPath, "project", "", "path to JSON project file (default FILE.json)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errUsage
+	}
+	pePath := fs.Arg(0)
+	if len(projectPath) == 0 {
+		projectPath = pathutil.TrimExt(pePath) + ".json"
+	}
+	if err := zelda.InitProject(projectPath, pePath); err != nil {
+		return errors.WithStack(err)
 	}
+	return nil
 }
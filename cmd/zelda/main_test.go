@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mewkiz/pkg/pathutil"
+	"github.com/mewmew/zelda"
+	"github.com/pkg/errors"
+)
+
+func TestRelinkCmdArgs(t *testing.T) {
+	golden := []struct {
+		name string
+		args []string
+		err  error
+		// Expected error message, if err is nil.
+		msg string
+	}{
+		{
+			name: "missing PE files",
+			args: nil,
+			err:  errUsage,
+		},
+		{
+			name: "output path and output directory",
+			args: []string{"-o", "foo.asm", "-outdir", t.TempDir(), "foo.exe"},
+			msg:  "unable to combine -o with -outdir",
+		},
+		{
+			name: "multiple PE files without output directory",
+			args: []string{"foo.exe", "bar.exe"},
+			msg:  "output directory required to relink 2 PE files; use -outdir",
+		},
+	}
+	for _, g := range golden {
+		err := relinkCmd(g.args)
+		switch {
+		case err == nil:
+			t.Errorf("%s: expected error, got nil", g.name)
+		case g.err != nil && errors.Cause(err) != g.err:
+			t.Errorf("%s: error mismatch; expected %v, got %v", g.name, g.err, err)
+		case g.err == nil && !strings.Contains(err.Error(), g.msg):
+			t.Errorf("%s: error mismatch; expected error containing %q, got %q", g.name, g.msg, err.Error())
+		}
+	}
+}
+
+func TestRunRelinkJobs(t *testing.T) {
+	dir := t.TempDir()
+	// PE file with an export table, which is not supported by the PE parser.
+	buf := &bytes.Buffer{}
+	dosHdr := make([]byte, 0x40)
+	copy(dosHdr, "MZ")
+	binary.LittleEndian.PutUint32(dosHdr[0x3C:], 0x40)
+	buf.Write(dosHdr)
+	buf.WriteString("PE\x00\x00")
+	binary.Write(buf, binary.LittleEndian, []uint16{0x014C, 0, 0, 0, 0, 0, 0, 0, 0xE0, 0x0102})
+	optHdr := make([]byte, 0x60)
+	binary.LittleEndian.PutUint16(optHdr, 0x010B)
+	binary.LittleEndian.PutUint32(optHdr[0x5C:], 16)
+	buf.Write(optHdr)
+	dataDirs := make([]uint32, 2*16)
+	dataDirs[0], dataDirs[1] = 0x1000, 0x40
+	binary.Write(buf, binary.LittleEndian, dataDirs)
+	panicPath := filepath.Join(dir, "panic.exe")
+	if err := ioutil.WriteFile(panicPath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pePaths := []string{
+		filepath.Join(dir, "missing.exe"),
+		panicPath,
+		filepath.Join(dir, "missing2.exe"),
+	}
+	var jobs []*relinkJob
+	for _, pePath := range pePaths {
+		job := &relinkJob{
+			pePath:    pePath,
+			opts:      zelda.Options{Output: pathutil.TrimExt(pePath) + ".asm"},
+			logPrefix: filepath.Base(pePath) + ": ",
+			done:      make(chan struct{}),
+		}
+		jobs = append(jobs, job)
+	}
+	out := &bytes.Buffer{}
+	failed, err := runRelinkJobs(out, jobs, 2, false)
+	if err != nil {
+		t.Fatalf("unable to run relink jobs; %v", err)
+	}
+	if failed != len(jobs) {
+		t.Errorf("number of failed jobs mismatch; expected %d, got %d", len(jobs), failed)
+	}
+	// Failures are reported in order of the jobs.
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != len(jobs) {
+		t.Fatalf("number of log lines mismatch; expected %d, got %d; %q", len(jobs), len(lines), out.String())
+	}
+	for i, line := range lines {
+		want := fmt.Sprintf("unable to relink %q: ", pePaths[i])
+		if !strings.Contains(line, want) {
+			t.Errorf("log line %d mismatch; expected line containing %q, got %q", i, want, line)
+		}
+	}
+	if want := "panic: support for data directory index 0 not yet implemented"; !strings.Contains(lines[1], want) {
+		t.Errorf("panic of job not recovered; expected log line containing %q, got %q", want, lines[1])
+	}
+}
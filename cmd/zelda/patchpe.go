@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/mewkiz/pkg/pathutil"
+	"github.com/mewmew/zelda"
+	"github.com/pkg/errors"
+)
+
+// patchCmd applies patches to a PE file, producing a patched PE file.
+func patchCmd(args []string) error {
+	fs := newFlagSet("patch", "FILE.exe", "Apply patches to a PE file, producing a patched PE file. Only patches which\nmodify section contents directly (-int, -nop, -replace and -patch_file) are\napplied; assembly patches require relinking. The PE file of the project file\nis patched if no PE file is specified.")
+	var output string
+	fs.StringVar(&output, "o", "", "path to patched PE file (default FILE_patched.exe)")
+	f := newOptionFlags(fs)
+	f.addPatchFlags()
+	fs.Parse(args)
+	opts, pePaths, err := f.options()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(pePaths) != 1 {
+		fs.Usage()
+		return errUsage
+	}
+	pePath := pePaths[0]
+	if len(output) == 0 {
+		output = pathutil.TrimExt(pePath) + "_patched.exe"
+	}
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	buf, err := zelda.PatchPE(pePath, opts, logger)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err := ioutil.WriteFile(output, buf, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
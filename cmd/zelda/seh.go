@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+
+	"github.com/mewkiz/pkg/pathutil"
+	"github.com/mewmew/zelda"
+	"github.com/pkg/errors"
+)
+
+// sehCmd generates the SEH runtime library of relinked executables.
+func sehCmd(args []string) error {
+	fs := newFlagSet("seh", "", "Generate the C source file and Makefile of the SEH runtime library\n("+zelda.SEHLib+", in DIR/libzelda_seh), which dispatches faulting\ninstructions of executables relinked with -seh to their SEH exception\nhandlers.")
+	var (
+		// Output directory of shims.
+		outDir string
+		// Overwrite existing SEH runtime.
+		force bool
+	)
+	fs.StringVar(&outDir, "outdir", "shims", "output directory of shims")
+	fs.BoolVar(&force, "f", false, "overwrite existing SEH runtime")
+	fs.Parse(args)
+	dir := filepath.Join(outDir, pathutil.TrimExt(zelda.SEHLib))
+	if !force && exists(filepath.Join(dir, zelda.SEHFiles()[0])) {
+		log.Printf("skipping existing SEH runtime %q; use -f to overwrite", dir)
+		return nil
+	}
+	if err := zelda.WriteSEH(dir); err != nil {
+		return errors.WithStack(err)
+	}
+	log.Printf("wrote SEH runtime %q", dir)
+	return nil
+}
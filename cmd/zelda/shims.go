@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mewmew/pe"
+	"github.com/mewmew/zelda"
+	"github.com/pkg/errors"
+)
+
+// shimsCmd generates skeleton shims of the imported libraries of PE files.
+func shimsCmd(args []string) error {
+	fs := newFlagSet("shims", "FILE.exe...", "Generate C source files and a Makefile of a skeleton shim for each imported\nlibrary of the PE files (DIR/NAME/NAME.c), with one stub per imported\nfunction. The PE file of the project file is used if no PE files are\nspecified.")
+	var (
+		// Output directory of shims.
+		outDir string
+		// Overwrite existing shims.
+		force bool
+	)
+	fs.StringVar(&outDir, "outdir", "shims", "output directory of shims")
+	fs.BoolVar(&force, "f", false, "overwrite existing shims")
+	f := newOptionFlags(fs)
+	f.addLibFlags()
+	fs.Parse(args)
+	opts, pePaths, err := f.options()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(pePaths) == 0 {
+		fs.Usage()
+		return errUsage
+	}
+	// Merge the imported libraries of PE files, keyed by shim file name.
+	var libs []zelda.Library
+	index := make(map[string]int)
+	for _, pePath := range pePaths {
+		file, err := pe.ParseFile(pePath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		impLibs, err := zelda.CollectLibs(file, opts)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, lib := range impLibs {
+			if len(lib.DLL) == 0 || isMapped(lib, opts) {
+				// Skip dynamic libraries of statically linked libraries and hook
+				// libraries, and imported libraries mapped to existing shared
+				// libraries.
+				continue
+			}
+			i, ok := index[lib.Filename]
+			if !ok {
+				index[lib.Filename] = len(libs)
+				libs = append(libs, lib)
+				continue
+			}
+			libs[i].Funcs = mergeFuncs(libs[i].Funcs, lib.Funcs)
+		}
+	}
+	for _, lib := range libs {
+		dir := filepath.Join(outDir, lib.Name)
+		if !force && exists(filepath.Join(dir, zelda.ShimFiles(lib)[0])) {
+			log.Printf("skipping existing shim %q of %q; use -f to overwrite", dir, lib.DLL)
+			continue
+		}
+		if err := zelda.WriteShim(dir, lib); err != nil {
+			return errors.WithStack(err)
+		}
+		log.Printf("wrote shim %q of %q (%d functions)", dir, lib.DLL, len(lib.Funcs))
+	}
+	return nil
+}
+
+// isMapped reports whether the given imported library is mapped to a shared
+// library by the library mapping of the relink options.
+func isMapped(lib zelda.Library, opts zelda.Options) bool {
+	for dll := range opts.Libs {
+		if strings.EqualFold(dll, lib.DLL) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeFuncs returns the union of the given imported functions, in order of
+// occurrence.
+func mergeFuncs(funcs, other []zelda.Func) []zelda.Func {
+	present := make(map[string]bool)
+	for _, fn := range funcs {
+		present[fn.Name] = true
+	}
+	for _, fn := range other {
+		if !present[fn.Name] {
+			present[fn.Name] = true
+			funcs = append(funcs, fn)
+		}
+	}
+	return funcs
+}
+
+// exists reports whether the given file exists.
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
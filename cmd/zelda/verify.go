@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mewmew/pe"
+	"github.com/mewmew/zelda"
+	"github.com/pkg/errors"
+)
+
+// verifyCmd checks the structure of ELF files produced from relinked PE files.
+func verifyCmd(args []string) error {
+	fs := newFlagSet("verify", "FILE...", "Check the structure of ELF files produced from relinked PE files (e.g. as\nassembled by \"nasm -f bin\").")
+	var pePath string
+	fs.StringVar(&pePath, "pe", "", "path to original PE file; check that its sections are mapped by the ELF files")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+	var sects []*zelda.Section
+	if len(pePath) > 0 {
+		file, err := pe.ParseFile(pePath)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		sects = zelda.ParseSections(file)
+	}
+	failed := 0
+	for _, elfPath := range fs.Args() {
+		problems, err := zelda.VerifyELF(elfPath, sects)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if len(problems) == 0 {
+			fmt.Printf("%s: ok\n", elfPath)
+			continue
+		}
+		for _, problem := range problems {
+			fmt.Printf("%s: %s\n", elfPath, problem)
+		}
+		failed++
+	}
+	if failed > 0 {
+		return errors.Errorf("verification failed for %d of %d ELF files", failed, fs.NArg())
+	}
+	return nil
+}
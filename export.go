@@ -1,4 +1,4 @@
-package main
+package zelda
 
 // Export is an exported symbol.
 type Export struct {
@@ -6,4 +6,7 @@ type Export struct {
 	Name string `json:"name"`
 	// Address of exported symbol.
 	Addr Address `json:"addr"`
+	// (optional) NASM label of exported symbol, used in place of Addr for
+	// symbols of generated code.
+	Label string `json:"-"`
 }
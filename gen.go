@@ -1,31 +1,27 @@
-package main
+package zelda
 
 import (
 	"bytes"
 	"debug/elf"
+	"embed"
 	"fmt"
 	"io"
-	"path/filepath"
+	"io/fs"
+	"os"
 	"strings"
 	"text/tabwriter"
 	"text/template"
 
-	"github.com/mewkiz/pkg/goutil"
 	"github.com/pkg/errors"
 )
 
 // --- [ File header ] ---------------------------------------------------------
 
 // dumpFileHdr outputs the ELF file header in NASM syntax based on the given
-// entry point address, writing to w.
-func dumpFileHdr(w io.Writer, entry Address, isSharedLib bool) error {
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	const tmplName = "ehdr.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).ParseFiles(tmplPath)
+// entry point address, writing to w. If startup is set, the entry point of the
+// ELF file is the startup stub, which jumps to the given entry point.
+func dumpFileHdr(w io.Writer, entry Address, isSharedLib, startup bool) error {
+	t, err := loadTemplate("ehdr.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -33,6 +29,7 @@ func dumpFileHdr(w io.Writer, entry Address, isSharedLib bool) error {
 	data := map[string]interface{}{
 		"Entry":       entry,
 		"IsSharedLib": isSharedLib,
+		"Startup":     startup,
 	}
 	if err := t.Execute(tw, data); err != nil {
 		return errors.WithStack(err)
@@ -57,21 +54,22 @@ type ProgHeader struct {
 	Flags string
 	// Alignment of segment.
 	Align string
+	// (optional) File offset of segment; defaults to the file offset of the
+	// named segment.
+	Offset string
+	// (optional) Virtual address of segment; defaults to the address of the
+	// named segment.
+	Addr string
+	// (optional) Size of segment in file; defaults to the size of the segment.
+	FileSize string
+	// (optional) Size of segment in memory; defaults to the size of the segment.
+	MemSize string
 }
 
 // dumpProgHdrs outputs the ELF program headers in NASM syntax based on the
 // given sections, writing to w.
 func dumpProgHdrs(w io.Writer, progHdrs []ProgHeader) error {
-	funcs := template.FuncMap{
-		"h2": h2,
-	}
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	const tmplName = "phdr.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).Funcs(funcs).ParseFiles(tmplPath)
+	t, err := loadTemplate("phdr.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -90,13 +88,7 @@ func dumpProgHdrs(w io.Writer, progHdrs []ProgHeader) error {
 // dumpRSegPre outputs the header of a read-only segment in NASM syntax based on
 // the given base address, writing to w.
 func dumpRSegPre(w io.Writer, base uint64) error {
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	const tmplName = "r_seg_pre.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).ParseFiles(tmplPath)
+	t, err := loadTemplate("r_seg_pre.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -116,13 +108,7 @@ func dumpRSegPre(w io.Writer, base uint64) error {
 // dumpRSegPost outputs the footer of a read-only segment in NASM syntax,
 // writing to w.
 func dumpRSegPost(w io.Writer) error {
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	const tmplName = "r_seg_post.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).ParseFiles(tmplPath)
+	t, err := loadTemplate("r_seg_post.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -139,13 +125,7 @@ func dumpRSegPost(w io.Writer) error {
 // dumpRWSegPre outputs the header of a read-write segment in NASM syntax,
 // writing to w.
 func dumpRWSegPre(w io.Writer) error {
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	const tmplName = "rw_seg_pre.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).ParseFiles(tmplPath)
+	t, err := loadTemplate("rw_seg_pre.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -162,13 +142,7 @@ func dumpRWSegPre(w io.Writer) error {
 // dumpRWSegPost outputs the footer of a read-write segment in NASM syntax,
 // writing to w.
 func dumpRWSegPost(w io.Writer) error {
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	const tmplName = "rw_seg_post.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).ParseFiles(tmplPath)
+	t, err := loadTemplate("rw_seg_post.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -185,13 +159,7 @@ func dumpRWSegPost(w io.Writer) error {
 // dumpXSegPre outputs the header of an executable segment in NASM syntax,
 // writing to w.
 func dumpXSegPre(w io.Writer) error {
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	const tmplName = "x_seg_pre.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).ParseFiles(tmplPath)
+	t, err := loadTemplate("x_seg_pre.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -208,13 +176,7 @@ func dumpXSegPre(w io.Writer) error {
 // dumpXSegPost outputs the footer of an executable segment in NASM syntax,
 // writing to w.
 func dumpXSegPost(w io.Writer) error {
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	const tmplName = "x_seg_post.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).ParseFiles(tmplPath)
+	t, err := loadTemplate("x_seg_post.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -234,13 +196,7 @@ func dumpXSegPost(w io.Writer) error {
 
 // dumpInterpSect outputs the .interp section in NASM syntax, writing to w.
 func dumpInterpSect(w io.Writer) error {
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	const tmplName = "interp.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).ParseFiles(tmplPath)
+	t, err := loadTemplate("interp.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -259,13 +215,7 @@ func dumpInterpSect(w io.Writer) error {
 // dumpHashSect outputs the .hash section in NASM syntax based on the given
 // exported symbols, writing to w.
 func dumpHashSect(w io.Writer, nglobals int) error {
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	const tmplName = "hash.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).ParseFiles(tmplPath)
+	t, err := loadTemplate("hash.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -291,15 +241,11 @@ func dumpHashSect(w io.Writer, nglobals int) error {
 // --- [ .dynamic section ] ----------------------------------------------------
 
 // dumpDynamicSect outputs the .dynamic section in NASM syntax based on the
-// given imported libraries, writing to w.
-func dumpDynamicSect(w io.Writer, libs []Library, exports []Export) error {
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	const tmplName = "dynamic.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).ParseFiles(tmplPath)
+// given imported libraries, writing to w. If dllMain is set, the entry point of
+// the DLL is called by the initialization and termination functions. If bindNow
+// is set, the dynamic linker resolves all symbols at load time.
+func dumpDynamicSect(w io.Writer, libs []Library, exports []Export, dllMain, bindNow bool) error {
+	t, err := loadTemplate("dynamic.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -307,6 +253,8 @@ func dumpDynamicSect(w io.Writer, libs []Library, exports []Export) error {
 	data := map[string]interface{}{
 		"Libs":    libs,
 		"Exports": exports,
+		"DllMain": dllMain,
+		"BindNow": bindNow,
 	}
 	if err := t.Execute(tw, data); err != nil {
 		return errors.WithStack(err)
@@ -320,13 +268,7 @@ func dumpDynamicSect(w io.Writer, libs []Library, exports []Export) error {
 // dumpDynstrSect outputs the .dynstr section in NASM syntax based on the given
 // imported libraries, writing to w.
 func dumpDynstrSect(w io.Writer, libs []Library, exports []Export) error {
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	const tmplName = "dynstr.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).ParseFiles(tmplPath)
+	t, err := loadTemplate("dynstr.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -347,13 +289,7 @@ func dumpDynstrSect(w io.Writer, libs []Library, exports []Export) error {
 // dumpDynsymSect outputs the .dynsym section in NASM syntax based on the given
 // imported libraries, writing to w.
 func dumpDynsymSect(w io.Writer, libs []Library, exports []Export) error {
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	const tmplName = "dynsym.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).ParseFiles(tmplPath)
+	t, err := loadTemplate("dynsym.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -374,18 +310,34 @@ func dumpDynsymSect(w io.Writer, libs []Library, exports []Export) error {
 // dumpRelPltSect outputs the .rel.plt section in NASM syntax based on the given
 // imported libraries, writing to w.
 func dumpRelPltSect(w io.Writer, libs []Library) error {
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
+	t, err := loadTemplate("rel_plt.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	const tmplName = "rel_plt.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).ParseFiles(tmplPath)
+	tw := tabwriter.NewWriter(w, 1, 3, 1, ' ', tabwriter.TabIndent)
+	if err := t.Execute(tw, libs); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := tw.Flush(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// dumpGotPltSect outputs the .got.plt section in NASM syntax based on the given
+// imported libraries, writing to w. If relro is set, .got.plt is padded to the
+// end of the page, to be made read-only after relocation.
+func dumpGotPltSect(w io.Writer, libs []Library, relro bool) error {
+	t, err := loadTemplate("got_plt.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
 	tw := tabwriter.NewWriter(w, 1, 3, 1, ' ', tabwriter.TabIndent)
-	if err := t.Execute(tw, libs); err != nil {
+	data := map[string]interface{}{
+		"Libs":  libs,
+		"Relro": relro,
+	}
+	if err := t.Execute(tw, data); err != nil {
 		return errors.WithStack(err)
 	}
 	if err := tw.Flush(); err != nil {
@@ -394,21 +346,42 @@ func dumpRelPltSect(w io.Writer, libs []Library) error {
 	return nil
 }
 
-// dumpGotPltSect outputs the .got.plt section in NASM syntax based on the given
-// imported libraries, writing to w.
-func dumpGotPltSect(w io.Writer, libs []Library) error {
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
+// dumpPltSect outputs the .plt section in NASM syntax based on the given
+// imported libraries, writing to w. If trace is set, calls to imported
+// functions are traced; outputting the stack arguments of the function
+// prototype if known, and traceArgs stack arguments otherwise.
+func dumpPltSect(w io.Writer, libs []Library, trace bool, traceArgs int) error {
+	t, err := loadTemplate("plt.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	const tmplName = "got_plt.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).ParseFiles(tmplPath)
+	tw := tabwriter.NewWriter(w, 1, 3, 1, ' ', tabwriter.TabIndent)
+	data := map[string]interface{}{
+		"Libs":      libs,
+		"Trace":     trace,
+		"TraceArgs": traceArgs,
+	}
+	if err := t.Execute(tw, data); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := tw.Flush(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// dumpTraceSect outputs the import call tracing routine in NASM syntax,
+// writing to w. At most maxArgs stack arguments are output per call.
+func dumpTraceSect(w io.Writer, maxArgs int) error {
+	t, err := loadTemplate("trace.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
 	tw := tabwriter.NewWriter(w, 1, 3, 1, ' ', tabwriter.TabIndent)
-	if err := t.Execute(tw, libs); err != nil {
+	data := map[string]interface{}{
+		"MaxArgs": maxArgs,
+	}
+	if err := t.Execute(tw, data); err != nil {
 		return errors.WithStack(err)
 	}
 	if err := tw.Flush(); err != nil {
@@ -417,21 +390,68 @@ func dumpGotPltSect(w io.Writer, libs []Library) error {
 	return nil
 }
 
-// dumpPltSect outputs the .plt section in NASM syntax based on the given
-// imported libraries, writing to w.
-func dumpPltSect(w io.Writer, libs []Library) error {
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
+// dumpTEBSect outputs the thread and process environment blocks of the main
+// thread in NASM syntax based on the given image base of the PE file, writing
+// to w.
+func dumpTEBSect(w io.Writer, imageBase Address) error {
+	t, err := loadTemplate("teb.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	const tmplName = "plt.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).ParseFiles(tmplPath)
+	data := map[string]interface{}{
+		"ImageBase": imageBase,
+	}
+	if err := t.Execute(w, data); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// dumpStartupSect outputs the startup stub in NASM syntax based on the given
+// entry point address of the PE file, writing to w. If seh is set, the startup
+// stub registers the signal handlers of the SEH runtime library.
+func dumpStartupSect(w io.Writer, entry Address, seh bool) error {
+	t, err := loadTemplate("startup.tmpl")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	data := map[string]interface{}{
+		"Entry": entry,
+		"SEH":   seh,
+	}
+	if err := t.Execute(w, data); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// dumpDllMainSect outputs the initialization and termination functions which
+// call the entry point of a DLL (DllMain) in NASM syntax, based on the given
+// image base and entry point address of the DLL, writing to w.
+func dumpDllMainSect(w io.Writer, imageBase, entry Address) error {
+	t, err := loadTemplate("dllmain.tmpl")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	data := map[string]interface{}{
+		"ImageBase": imageBase,
+		"Entry":     entry,
+	}
+	if err := t.Execute(w, data); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// dumpHooksSect outputs the trampolines of hooked functions in NASM syntax,
+// writing to w.
+func dumpHooksSect(w io.Writer, hooks []Hook) error {
+	t, err := loadTemplate("hooks.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
 	tw := tabwriter.NewWriter(w, 1, 3, 1, ' ', tabwriter.TabIndent)
-	if err := t.Execute(tw, libs); err != nil {
+	if err := t.Execute(tw, hooks); err != nil {
 		return errors.WithStack(err)
 	}
 	if err := tw.Flush(); err != nil {
@@ -447,8 +467,6 @@ func genSectContent(sect *Section, fs ...func(w io.Writer, addr Address, buf []b
 	out := &bytes.Buffer{}
 	addr := sect.Addr
 loop:
-	// TODO: only print the first Size bytes of Data (when len(Data) > Size).
-	// Mark the remaining bytes of Data as padding.
 	for i := 0; i < len(sect.Data); {
 		buf := sect.Data[i:]
 		fmt.Fprintf(out, "; address: %s\n", addr)
@@ -475,32 +493,19 @@ loop:
 		i++
 		addr++
 	}
-	// Uninitialized data.
-	// TODO: use pretty-printer functions also for uninitialized data.
-	if sect.Size > int64(len(sect.Data)) {
-		n := sect.Size - int64(len(sect.Data))
-		out.WriteString("; Uninitialized data.\n")
-		fmt.Fprintf(out, "resb %d\n", n)
-	}
+	// Uninitialized data is not stored in the file, but zero-filled by the loader
+	// (memsz > filesz); patches of uninitialized data are rejected by the patch
+	// plan.
 	return out.String(), nil
 }
 
-// dumpSect outputs the given PE section in NASM syntax and PE library imports,
-// writing to w.
-func dumpSect(w io.Writer, sect *Section, prevSeg string, content string) error {
-	funcs := template.FuncMap{
-		"h0":    h0,
-		"h0End": h0End,
-		"h2":    h2,
-		"h2End": h2End,
-	}
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	const tmplName = "sect.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).Funcs(funcs).ParseFiles(tmplPath)
+// dumpSect outputs the i:th PE section of the given loadable segment in NASM
+// syntax and PE library imports, writing to w. Sections are padded to the
+// following section of the same segment, and the last section of a segment is
+// padded to page alignment.
+func dumpSect(w io.Writer, seg *Segment, i int, prevSeg string, content string) error {
+	sect := seg.Sects[i]
+	t, err := loadTemplate("sect.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -514,8 +519,14 @@ func dumpSect(w io.Writer, sect *Section, prevSeg string, content string) error
 		"Ident":   nasmIdent(sect.Name),
 		"PrevSeg": prevSeg,
 		"Addr":    sect.Addr,
+		"Start":   seg.start(i),
+		"Lead":    int64(sect.Addr - seg.start(i)),
+		"Next":    seg.next(i),
+		"Aligned": seg.start(i)%pageSize == 0,
 		"Content": content,
 		"Pad":     pad,
+		"Size":    sect.Size,
+		"Uninit":  sect.Size - int64(len(sect.Data)),
 	}
 	if err := t.Execute(tw, data); err != nil {
 		return errors.WithStack(err)
@@ -526,19 +537,34 @@ func dumpSect(w io.Writer, sect *Section, prevSeg string, content string) error
 	return nil
 }
 
-// dumpShstrtabSect outputs the .shstrtab section in NASM syntax based on the
-// given sections, writing to w.
-func dumpShstrtabSect(w io.Writer, prevSeg string, sects []*Section) error {
-	funcs := template.FuncMap{
-		"nasmIdent": nasmIdent,
-	}
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
+// dumpNoAllocSect outputs the given PE section not allocated in memory in NASM
+// syntax, writing to w. The section is stored in the file following prevSeg.
+func dumpNoAllocSect(w io.Writer, sect *Section, prevSeg string, content string) error {
+	t, err := loadTemplate("noalloc_sect.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	const tmplName = "shstrtab.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).Funcs(funcs).ParseFiles(tmplPath)
+	tw := tabwriter.NewWriter(w, 1, 3, 1, ' ', tabwriter.TabIndent)
+	data := map[string]interface{}{
+		"Name":    sect.Name,
+		"Ident":   nasmIdent(sect.Name),
+		"PrevSeg": prevSeg,
+		"Addr":    sect.Addr,
+		"Content": content,
+	}
+	if err := t.Execute(tw, data); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := tw.Flush(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// dumpShstrtabSect outputs the .shstrtab section in NASM syntax based on the
+// given sections, writing to w.
+func dumpShstrtabSect(w io.Writer, prevSeg string, sects []*Section) error {
+	t, err := loadTemplate("shstrtab.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -559,17 +585,7 @@ func dumpShstrtabSect(w io.Writer, prevSeg string, sects []*Section) error {
 // dumpLibImps outputs a redirection from the given PE import entries to their
 // corresponding ELF dynamic symbols in NASM syntax, writing to w.
 func dumpLibImps(w io.Writer, lib Library) error {
-	funcs := template.FuncMap{
-		"h2":    h2,
-		"h2End": h2End,
-	}
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	const tmplName = "lib_imps.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).Funcs(funcs).ParseFiles(tmplPath)
+	t, err := loadTemplate("lib_imps.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -586,15 +602,9 @@ func dumpLibImps(w io.Writer, lib Library) error {
 // --- [ Section headers ] -----------------------------------------------------
 
 // dumpSectHdrs outputs the ELF section headers in NASM syntax based on the
-// given sections, writing to w.
-func dumpSectHdrs(w io.Writer, sects []*Section, hasGlobal bool) error {
-	srcDir, err := goutil.SrcDir("github.com/mewmew/zelda/cmd/zelda")
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	const tmplName = "shdr.tmpl"
-	tmplPath := filepath.Join(srcDir, tmplName)
-	t, err := template.New(tmplName).ParseFiles(tmplPath)
+// given sections and their loadable segments, writing to w.
+func dumpSectHdrs(w io.Writer, sects []*Section, segs []*Segment, hasGlobal bool) error {
+	t, err := loadTemplate("shdr.tmpl")
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -604,14 +614,44 @@ func dumpSectHdrs(w io.Writer, sects []*Section, hasGlobal bool) error {
 	// Prepare data for template.
 	type ELFSection struct {
 		Name  string
+		Type  string
 		Flags string
+		Size  string
+	}
+	// The uninitialized data of sections followed by another section of the same
+	// loadable segment is stored in the file.
+	stored := make(map[*Section]bool)
+	for _, seg := range segs {
+		for i, sect := range seg.Sects {
+			if seg.next(i) != 0 {
+				stored[sect] = true
+			}
+		}
 	}
 	var elfSects []ELFSection
 	for _, sect := range sects {
 		flags := elfSectionFlag(sect.Perm)
+		name := nasmIdent(sect.Name)
 		elfSect := ELFSection{
-			Name:  nasmIdent(sect.Name),
+			Name:  name,
+			Type:  "SHT_PROGBITS",
 			Flags: SectionFlagString(flags),
+			Size:  name + ".size",
+		}
+		switch {
+		case sect.NoAlloc:
+			// Section stored in the file without occupying memory.
+			elfSect.Flags = SectionFlagString(0)
+		case stored[sect]:
+			// Uninitialized data stored in the file as zeros; nothing to do.
+		case len(sect.Data) == 0 && sect.Size > 0:
+			// Purely uninitialized section (e.g. .bss).
+			elfSect.Type = "SHT_NOBITS"
+			elfSect.Size = name + ".memsz"
+		case sect.Size > int64(len(sect.Data)):
+			// Initialized contents of section; the uninitialized data is only
+			// part of the memory size of its loadable segment.
+			elfSect.Size = name + ".filesz"
 		}
 		elfSects = append(elfSects, elfSect)
 	}
@@ -628,6 +668,79 @@ func dumpSectHdrs(w io.Writer, sects []*Section, hasGlobal bool) error {
 	return nil
 }
 
+// --- [ Templates ] -----------------------------------------------------------
+
+// templateFS holds the embedded NASM templates of ELF file structures, and the
+// C templates of shim libraries.
+//
+//go:embed *.tmpl
+var templateFS embed.FS
+
+// templateFuncs are the functions available to templates.
+var templateFuncs = template.FuncMap{
+	"h0":        h0,
+	"h0End":     h0End,
+	"h2":        h2,
+	"h2End":     h2End,
+	"nasmIdent": nasmIdent,
+}
+
+// templates maps from template name to parsed template. Templates are parsed
+// once at startup and shared between concurrent relink jobs.
+var templates = make(map[string]*template.Template)
+
+func init() {
+	if err := parseTemplates(templateFS, false); err != nil {
+		panic(fmt.Sprintf("%+v", err))
+	}
+}
+
+// OverrideTemplates overrides the embedded templates with the template files
+// (*.tmpl) of the given directory.
+func OverrideTemplates(dir string) error {
+	if err := parseTemplates(os.DirFS(dir), true); err != nil {
+		return errors.Wrapf(err, "unable to override templates with templates of directory %q", dir)
+	}
+	return nil
+}
+
+// parseTemplates parses the template files (*.tmpl) of the given file system.
+// If override is set, the template files must override existing templates.
+// Templates are updated only if all template files parse successfully.
+func parseTemplates(fsys fs.FS, override bool) error {
+	tmplNames, err := fs.Glob(fsys, "*.tmpl")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(tmplNames) == 0 {
+		return errors.New("no template files found")
+	}
+	parsed := make(map[string]*template.Template)
+	for _, tmplName := range tmplNames {
+		if _, ok := templates[tmplName]; override && !ok {
+			return errors.Errorf("unknown template %q", tmplName)
+		}
+		t, err := template.New(tmplName).Funcs(templateFuncs).ParseFS(fsys, tmplName)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		parsed[tmplName] = t
+	}
+	for tmplName, t := range parsed {
+		templates[tmplName] = t
+	}
+	return nil
+}
+
+// loadTemplate returns the parsed template of the given name.
+func loadTemplate(tmplName string) (*template.Template, error) {
+	t, ok := templates[tmplName]
+	if !ok {
+		return nil, errors.Errorf("unable to locate template %q", tmplName)
+	}
+	return t, nil
+}
+
 // ### [ Helper functions ] ####################################################
 
 // hexdump outputs the given data as a hexdump in NASM format.
@@ -672,6 +785,52 @@ func isPrint(b byte) bool {
 	return ' ' <= b && b <= '~'
 }
 
+// generatedIdents is the set of NASM identifiers of generated segments and
+// sections, and of their program and section header entries.
+var generatedIdents = map[string]bool{
+	"null":          true,
+	"ehdr":          true,
+	"phdr":          true,
+	"shdr":          true,
+	"r_seg":         true,
+	"rw_seg":        true,
+	"x_seg":         true,
+	"interp":        true,
+	"hash":          true,
+	"dynstr":        true,
+	"dynsym":        true,
+	"rel_plt":       true,
+	"dynamic":       true,
+	"dynamic_align": true,
+	"got_plt":       true,
+	"relro":         true,
+	"gnu_stack":     true,
+	"teb":           true,
+	"teb_desc":      true,
+	"peb":           true,
+	"plt":           true,
+	"plt_entsize":   true,
+	"trace":         true,
+	"hooks":         true,
+	"dllmain":       true,
+	"dll_init":      true,
+	"dll_fini":      true,
+	"startup":       true,
+	"shstrtab":      true,
+}
+
+// isGeneratedIdent reports whether the given NASM identifier is used by a
+// generated segment or section, either directly or with the suffix of its file
+// offset (e.g. "plt_off") or section header index (e.g. "plt_idx").
+func isGeneratedIdent(ident string) bool {
+	for _, suffix := range []string{"", "_off", "_idx"} {
+		if strings.HasSuffix(ident, suffix) && generatedIdents[strings.TrimSuffix(ident, suffix)] {
+			return true
+		}
+	}
+	return false
+}
+
 // h0 returns a h0 heading as an 80-column NASM comment.
 func h0(title string) string {
 	// ___ [ title ] ___
@@ -0,0 +1,165 @@
+package zelda
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+	"testing/fstest"
+	"text/template"
+)
+
+func TestDumpSectHdrsMergedUninit(t *testing.T) {
+	// .data has uninitialized data, and shares a page with .rsrc; its
+	// uninitialized data is therefore stored in the file.
+	data := &Section{
+		Name: ".data",
+		Data: make([]byte, 0x200),
+		Size: 0x390,
+		Addr: 0x403000,
+		Perm: PermR | PermW,
+	}
+	bss := &Section{
+		Name: ".bss",
+		Size: 0x80,
+		Addr: 0x403400,
+		Perm: PermR | PermW,
+	}
+	rsrc := &Section{
+		Name: ".rsrc",
+		Data: make([]byte, 0x100),
+		Size: 0x180,
+		Addr: 0x403800,
+		Perm: PermR,
+	}
+	sects := []*Section{data, bss, rsrc}
+	segs, err := loadSegments(sects, discard)
+	if err != nil {
+		t.Fatalf("unable to load segments; %v", err)
+	}
+	if len(segs) != 1 {
+		t.Fatalf("number of segments mismatch; expected 1, got %d", len(segs))
+	}
+	buf := &bytes.Buffer{}
+	if err := dumpSectHdrs(buf, sects, segs, false); err != nil {
+		t.Fatalf("unable to dump section headers; %v", err)
+	}
+	golden := []struct {
+		name string
+		typ  string
+		size string
+	}{
+		{name: "_data", typ: "SHT_PROGBITS", size: "_data.size"},
+		{name: "_bss", typ: "SHT_PROGBITS", size: "_bss.size"},
+		// Last section of segment; uninitialized data zero-filled by the loader.
+		{name: "_rsrc", typ: "SHT_PROGBITS", size: "_rsrc.filesz"},
+	}
+	for _, g := range golden {
+		re := regexp.MustCompile(`(?m)^  \.` + g.name + `:\n.*\n\tdd +(\S+) .*\n.*\n.*\n.*\n\tdd +(\S+) `)
+		m := re.FindStringSubmatch(buf.String())
+		if m == nil {
+			t.Errorf("%s: unable to locate section header", g.name)
+			continue
+		}
+		if m[1] != g.typ {
+			t.Errorf("%s: section type mismatch; expected %q, got %q", g.name, g.typ, m[1])
+		}
+		if m[2] != g.size {
+			t.Errorf("%s: section size mismatch; expected %q, got %q", g.name, g.size, m[2])
+		}
+	}
+}
+
+func TestDumpSectHdrsNoBits(t *testing.T) {
+	// .bss is purely uninitialized and the last section of its segment; it
+	// occupies no space in the file.
+	data := &Section{
+		Name: ".data",
+		Data: make([]byte, 0x200),
+		Size: 0x200,
+		Addr: 0x403000,
+		Perm: PermR | PermW,
+	}
+	bss := &Section{
+		Name: ".bss",
+		Size: 0x80,
+		Addr: 0x404000,
+		Perm: PermR | PermW,
+	}
+	sects := []*Section{data, bss}
+	segs, err := loadSegments(sects, discard)
+	if err != nil {
+		t.Fatalf("unable to load segments; %v", err)
+	}
+	buf := &bytes.Buffer{}
+	if err := dumpSectHdrs(buf, sects, segs, false); err != nil {
+		t.Fatalf("unable to dump section headers; %v", err)
+	}
+	golden := []struct {
+		name string
+		typ  string
+		size string
+	}{
+		{name: "_data", typ: "SHT_PROGBITS", size: "_data.size"},
+		{name: "_bss", typ: "SHT_NOBITS", size: "_bss.memsz"},
+	}
+	for _, g := range golden {
+		re := regexp.MustCompile(`(?m)^  \.` + g.name + `:\n.*\n\tdd +(\S+) .*\n.*\n.*\n.*\n\tdd +(\S+) `)
+		m := re.FindStringSubmatch(buf.String())
+		if m == nil {
+			t.Errorf("%s: unable to locate section header", g.name)
+			continue
+		}
+		if m[1] != g.typ {
+			t.Errorf("%s: section type mismatch; expected %q, got %q", g.name, g.typ, m[1])
+		}
+		if m[2] != g.size {
+			t.Errorf("%s: section size mismatch; expected %q, got %q", g.name, g.size, m[2])
+		}
+	}
+}
+
+func TestParseTemplatesOverride(t *testing.T) {
+	golden := []struct {
+		name string
+		fsys fstest.MapFS
+		err  string
+	}{
+		{
+			name: "partially invalid",
+			fsys: fstest.MapFS{
+				"interp.tmpl": {Data: []byte("overridden")},
+				"sect.tmpl":   {Data: []byte("{{ .Foo ")},
+			},
+			err: "unclosed action",
+		},
+		{
+			name: "unknown template",
+			fsys: fstest.MapFS{
+				"interp.tmpl": {Data: []byte("overridden")},
+				"foo.tmpl":    {Data: []byte("foo")},
+			},
+			err: `unknown template "foo.tmpl"`,
+		},
+		{
+			name: "no templates",
+			fsys: fstest.MapFS{
+				"foo.txt": {Data: []byte("foo")},
+			},
+			err: "no template files found",
+		},
+	}
+	for _, g := range golden {
+		before := make(map[string]*template.Template)
+		for tmplName, tmpl := range templates {
+			before[tmplName] = tmpl
+		}
+		err := parseTemplates(g.fsys, true)
+		checkErr(t, g.name, err, g.err)
+		// Templates are left unchanged on failure.
+		for tmplName, tmpl := range before {
+			if templates[tmplName] != tmpl {
+				t.Errorf("%s: template %q overridden on failure", g.name, tmplName)
+			}
+		}
+	}
+}
@@ -1,9 +1,10 @@
 module github.com/mewmew/zelda
 
-go 1.12
+go 1.16
 
 require (
 	github.com/mewkiz/pkg v0.0.0-20200212014339-e3282939ac6c
 	github.com/mewmew/pe v0.0.0-20190308153105-a3ed7aa3c65a
 	github.com/pkg/errors v0.8.1
+	golang.org/x/arch v0.0.0-20200312215426-ff8b605520f4
 )
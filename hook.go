@@ -0,0 +1,167 @@
+package zelda
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/arch/x86/x86asm"
+)
+
+// HookLib is a dynamic library of hook functions.
+type HookLib struct {
+	// File name of hook library.
+	Filename string `json:"filename"`
+	// Hooked functions.
+	Funcs []HookFunc `json:"funcs"`
+}
+
+// HookFunc is a function of the executable which is intercepted by the
+// function of the same name in the hook library. The original function remains
+// callable as "orig_<name>".
+type HookFunc struct {
+	// Address of hooked function in executable.
+	Addr Address `json:"addr"`
+	// Function name.
+	Name string `json:"name"`
+}
+
+// Hook is a hooked function with its relocated prologue.
+type Hook struct {
+	// Function name.
+	Name string
+	// Address of hooked function in executable.
+	Addr Address
+	// Size in bytes of the prologue overwritten by the hook; at least the size
+	// of a near jump.
+	Size int
+	// Relocated prologue instructions in NASM syntax.
+	Prologue string
+}
+
+// OrigName returns the name of the trampoline through which the original
+// function remains callable.
+func (hook Hook) OrigName() string {
+	return "orig_" + hook.Name
+}
+
+// jmpSize is the size in bytes of a near jump (jmp rel32), as injected at hook
+// sites and static library injection sites.
+const jmpSize = 5
+
+// parseHooks decodes the prologues of the functions hooked by the given hook
+// libraries, which are relocated into trampolines of the executable segment.
+func parseHooks(sects []*Section, hookLibs []HookLib) ([]Hook, error) {
+	var hooks []Hook
+	for _, hookLib := range hookLibs {
+		for _, fn := range hookLib.Funcs {
+			hook, err := parseHook(sects, fn)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks, nil
+}
+
+// parseHook decodes the prologue of the given hooked function, relocating its
+// instructions to be placed in a trampoline. Prologues with relative branches
+// into the prologue itself are rejected, as the branch targets are overwritten
+// by the hook.
+func parseHook(sects []*Section, fn HookFunc) (Hook, error) {
+	data, ok := sectData(sects, fn.Addr)
+	if !ok {
+		return Hook{}, errors.Errorf("unable to locate section of hooked function %q at address %s", fn.Name, fn.Addr)
+	}
+	prologue := &bytes.Buffer{}
+	// Relative branches of prologue.
+	type branch struct {
+		// Address of branch instruction.
+		addr Address
+		// Target address of branch.
+		target Address
+	}
+	var branches []branch
+	n := 0
+	for n < jmpSize {
+		addr := fn.Addr + Address(n)
+		inst, err := x86asm.Decode(data[n:], 32)
+		if err != nil {
+			return Hook{}, errors.Wrapf(err, "unable to decode instruction of hooked function %q at address %s", fn.Name, addr)
+		}
+		next := addr + Address(inst.Len)
+		switch inst.Op {
+		case x86asm.RET, x86asm.LRET, x86asm.JMP, x86asm.LJMP, x86asm.INT, x86asm.UD2:
+			if next-fn.Addr < jmpSize {
+				return Hook{}, errors.Errorf("unable to hook function %q at address %s; function ends at %s, before the first %d bytes", fn.Name, fn.Addr, addr, jmpSize)
+			}
+		}
+		asm := x86asm.IntelSyntax(inst, uint64(addr), nil)
+		rel, isRel := inst.Args[0].(x86asm.Rel)
+		switch {
+		case !isRel:
+			// Position independent instruction; copy as is.
+			fmt.Fprintf(prologue, "\tdb      %s ; %s\n", hexBytes(data[n:n+inst.Len]), asm)
+		case inst.Op == x86asm.CALL, inst.Op == x86asm.JMP, isJcc(inst.Op):
+			// Relative branch; re-encode with absolute target address.
+			target := next + Address(int64(rel))
+			branches = append(branches, branch{addr: addr, target: target})
+			mnemonic := strings.ToLower(inst.Op.String())
+			if inst.Op == x86asm.CALL {
+				fmt.Fprintf(prologue, "\tcall    %s\n", target)
+			} else {
+				fmt.Fprintf(prologue, "\t%-7s near %s\n", mnemonic, target)
+			}
+		default:
+			return Hook{}, errors.Errorf("unable to relocate instruction %q of hooked function %q at address %s", asm, fn.Name, addr)
+		}
+		n += inst.Len
+	}
+	end := fn.Addr + Address(n)
+	for _, b := range branches {
+		if fn.Addr <= b.target && b.target < end {
+			return Hook{}, errors.Errorf("unable to hook function %q at address %s; branch at %s targets %s, within the %d bytes of the prologue overwritten by the hook", fn.Name, fn.Addr, b.addr, b.target, n)
+		}
+	}
+	hook := Hook{
+		Name:     fn.Name,
+		Addr:     fn.Addr,
+		Size:     n,
+		Prologue: prologue.String(),
+	}
+	return hook, nil
+}
+
+// isJcc reports whether the given instruction opcode is a conditional jump
+// with a near (rel32) encoding.
+func isJcc(op x86asm.Op) bool {
+	switch op {
+	case x86asm.JA, x86asm.JAE, x86asm.JB, x86asm.JBE, x86asm.JE, x86asm.JG, x86asm.JGE, x86asm.JL, x86asm.JLE, x86asm.JNE, x86asm.JNO, x86asm.JNP, x86asm.JNS, x86asm.JO, x86asm.JP, x86asm.JS:
+		return true
+	}
+	return false
+}
+
+// sectData returns the contents of the section starting at the given address.
+// The boolean return value indicates success.
+func sectData(sects []*Section, addr Address) ([]byte, bool) {
+	for _, sect := range sects {
+		end := sect.Addr + Address(len(sect.Data))
+		if sect.Addr <= addr && addr < end {
+			return sect.Data[addr-sect.Addr:], true
+		}
+	}
+	return nil, false
+}
+
+// hexBytes returns the given bytes as a comma-separated list of hexadecimal
+// NASM constants.
+func hexBytes(buf []byte) string {
+	var ss []string
+	for _, b := range buf {
+		ss = append(ss, fmt.Sprintf("0x%02X", b))
+	}
+	return strings.Join(ss, ", ")
+}
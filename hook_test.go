@@ -0,0 +1,112 @@
+package zelda
+
+import "testing"
+
+func TestParseHook(t *testing.T) {
+	golden := []struct {
+		name string
+		code []byte
+		size int
+		// Relocated prologue instructions.
+		want string
+		err  string
+	}{
+		{
+			name: "frame setup",
+			// push ebp; mov ebp, esp; sub esp, 0x10
+			code: []byte{0x55, 0x89, 0xE5, 0x83, 0xEC, 0x10},
+			size: 6,
+			want: "\tdb      0x55 ; push ebp\n" +
+				"\tdb      0x89, 0xE5 ; mov ebp, esp\n" +
+				"\tdb      0x83, 0xEC, 0x10 ; sub esp, 0x10\n",
+		},
+		{
+			name: "call",
+			// call 0x401105
+			code: []byte{0xE8, 0x00, 0x01, 0x00, 0x00},
+			size: 5,
+			want: "\tcall    0x401105\n",
+		},
+		{
+			name: "jmp short",
+			// push ebp; mov ebp, esp; jmp short 0x401015
+			code: []byte{0x55, 0x89, 0xE5, 0xEB, 0x10},
+			size: 5,
+			want: "\tdb      0x55 ; push ebp\n" +
+				"\tdb      0x89, 0xE5 ; mov ebp, esp\n" +
+				"\tjmp     near 0x401015\n",
+		},
+		{
+			name: "jcc short",
+			// test eax, eax; je short 0x401014; push ebp
+			code: []byte{0x85, 0xC0, 0x74, 0x10, 0x55},
+			size: 5,
+			want: "\tdb      0x85, 0xC0 ; test eax, eax\n" +
+				"\tje      near 0x401014\n" +
+				"\tdb      0x55 ; push ebp\n",
+		},
+		{
+			name: "jcc near backwards",
+			// test eax, eax; jne near 0x400F00
+			code: []byte{0x85, 0xC0, 0x0F, 0x85, 0xF8, 0xFE, 0xFF, 0xFF},
+			size: 8,
+			want: "\tdb      0x85, 0xC0 ; test eax, eax\n" +
+				"\tjne     near 0x400F00\n",
+		},
+		{
+			name: "jcc into prologue",
+			// test eax, eax; jne short 0x401002; nop
+			code: []byte{0x85, 0xC0, 0x75, 0xFE, 0x90},
+			err:  `unable to hook function "foo" at address 0x401000; branch at 0x401002 targets 0x401002, within the 5 bytes of the prologue overwritten by the hook`,
+		},
+		{
+			name: "jcc to start of prologue",
+			// xor eax, eax; inc eax; jne short 0x401000
+			code: []byte{0x31, 0xC0, 0x40, 0x75, 0xFB},
+			err:  `branch at 0x401003 targets 0x401000, within the 5 bytes of the prologue`,
+		},
+		{
+			name: "jcc past prologue",
+			// test eax, eax; jne short 0x401005; nop
+			code: []byte{0x85, 0xC0, 0x75, 0x01, 0x90, 0x90},
+			size: 5,
+			want: "\tdb      0x85, 0xC0 ; test eax, eax\n" +
+				"\tjne     near 0x401005\n" +
+				"\tdb      0x90 ; nop\n",
+		},
+		{
+			name: "short function",
+			// xor eax, eax; ret
+			code: []byte{0x31, 0xC0, 0xC3, 0x90, 0x90},
+			err:  `unable to hook function "foo" at address 0x401000; function ends at 0x401002, before the first 5 bytes`,
+		},
+		{
+			name: "loop",
+			// mov ecx, 4; loop 0x401005
+			code: []byte{0xB9, 0x04, 0x00, 0x00, 0x00, 0xE2, 0xFE},
+			size: 5,
+			want: "\tdb      0xB9, 0x04, 0x00, 0x00, 0x00 ; mov ecx, 0x4\n",
+		},
+		{
+			name: "position dependent",
+			// loop 0x401000; mov ecx, 4
+			code: []byte{0xE2, 0xFE, 0xB9, 0x04, 0x00, 0x00, 0x00},
+			err:  `unable to relocate instruction`,
+		},
+	}
+	for _, g := range golden {
+		sects := []*Section{
+			{Name: ".text", Data: g.code, Size: int64(len(g.code)), Addr: 0x401000, Perm: PermR | PermX},
+		}
+		hook, err := parseHook(sects, HookFunc{Addr: 0x401000, Name: "foo"})
+		if !checkErr(t, g.name, err, g.err) {
+			continue
+		}
+		if hook.Size != g.size {
+			t.Errorf("%s: prologue size mismatch; expected %d, got %d", g.name, g.size, hook.Size)
+		}
+		if hook.Prologue != g.want {
+			t.Errorf("%s: prologue mismatch; expected %q, got %q", g.name, g.want, hook.Prologue)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package zelda
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Library is a shared library.
+type Library struct {
+	// Library name.
+	Name string
+	// Library file name.
+	Filename string
+	// DLL file name of imported library; or empty if not imported by the PE
+	// file.
+	DLL string
+	// Imported functions.
+	Funcs []Func
+}
+
+// Func is an imported function.
+type Func struct {
+	// Function name.
+	Name string
+	// Size in bytes of the stack arguments of the function, if the callee cleans
+	// the stack (__stdcall); and 0 if the caller cleans the stack (__cdecl).
+	ArgSize int
+	// (optional) Function prototype.
+	Proto *Proto
+}
+
+// TraceArgs returns the number of stack arguments to output when tracing calls
+// to the function; as determined by its stack argument size or prototype if
+// known, and def otherwise. At least def arguments are output for variadic
+// functions.
+func (fn Func) TraceArgs(def int) int {
+	switch {
+	case fn.ArgSize > 0:
+		return fn.ArgSize / 4
+	case fn.Proto != nil && fn.Proto.Variadic:
+		if n := fn.Proto.ArgSize() / 4; n > def {
+			return n
+		}
+		return def
+	case fn.Proto != nil:
+		return fn.Proto.ArgSize() / 4
+	}
+	return def
+}
+
+// StdcallFunc specifies the size of the stack arguments of a __stdcall
+// function.
+type StdcallFunc struct {
+	// Function name.
+	Name string `json:"name"`
+	// Size in bytes of stack arguments popped by the callee.
+	ArgSize int `json:"argsize"`
+}
+
+// setArgSizes sets the stack argument size of each __stdcall function of the
+// given libraries, either as specified by stdcallFuncs, as encoded by the
+// decorated function name (e.g. "_Sleep@4"), or as determined by the function
+// prototype.
+func setArgSizes(libs []Library, stdcallFuncs []StdcallFunc) error {
+	argSizes := make(map[string]int)
+	for _, fn := range stdcallFuncs {
+		if prev, ok := argSizes[fn.Name]; ok && prev != fn.ArgSize {
+			return errors.Errorf("conflicting stack argument sizes of function %q; %d and %d", fn.Name, prev, fn.ArgSize)
+		}
+		argSizes[fn.Name] = fn.ArgSize
+	}
+	for i := range libs {
+		lib := &libs[i]
+		for j := range lib.Funcs {
+			fn := &lib.Funcs[j]
+			argSize, ok := argSizes[fn.Name]
+			if !ok {
+				argSize, ok = decoratedArgSize(fn.Name)
+			}
+			if !ok && fn.Proto != nil && fn.Proto.Stdcall {
+				argSize, ok = fn.Proto.ArgSize(), true
+			}
+			if !ok {
+				continue
+			}
+			if argSize < 0 || argSize%4 != 0 {
+				return errors.Errorf("invalid stack argument size of function %q; expected non-negative multiple of 4, got %d", fn.Name, argSize)
+			}
+			fn.ArgSize = argSize
+		}
+	}
+	return nil
+}
+
+// decoratedArgSize returns the size of the stack arguments encoded by the given
+// decorated __stdcall function name (e.g. "_Sleep@4"). The boolean return value
+// indicates success.
+func decoratedArgSize(name string) (int, bool) {
+	if strings.HasPrefix(name, "@") {
+		// __fastcall function (e.g. "@Foo@8"); arguments partially passed in
+		// registers.
+		return 0, false
+	}
+	pos := strings.LastIndex(name, "@")
+	if pos == -1 {
+		return 0, false
+	}
+	argSize, err := strconv.Atoi(name[pos+1:])
+	if err != nil {
+		return 0, false
+	}
+	return argSize, true
+}
+
+// mapLibs sets the file names of the given imported libraries, as mapped from
+// DLL file name (case-insensitive) by libMap.
+func mapLibs(libs []Library, libMap map[string]string) error {
+	var dlls []string
+	for dll := range libMap {
+		dlls = append(dlls, dll)
+	}
+	sort.Strings(dlls)
+	for _, dll := range dlls {
+		found := false
+		for i := range libs {
+			if strings.EqualFold(libs[i].DLL, dll) {
+				libs[i].Filename = libMap[dll]
+				found = true
+			}
+		}
+		if !found {
+			return errors.Errorf("unable to locate imported library %q of library mapping", dll)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package zelda
+
+import "testing"
+
+func TestDecoratedArgSize(t *testing.T) {
+	golden := []struct {
+		name    string
+		argSize int
+		ok      bool
+	}{
+		{name: "_Sleep@4", argSize: 4, ok: true},
+		{name: "_Foo@12", argSize: 12, ok: true},
+		{name: "Foo@0", argSize: 0, ok: true},
+		{name: "Foo@x", ok: false},
+		{name: "Foo@", ok: false},
+		{name: "Foo", ok: false},
+		// __fastcall.
+		{name: "@Foo@8", ok: false},
+	}
+	for _, g := range golden {
+		argSize, ok := decoratedArgSize(g.name)
+		if ok != g.ok {
+			t.Errorf("%q: success mismatch; expected %v, got %v", g.name, g.ok, ok)
+			continue
+		}
+		if argSize != g.argSize {
+			t.Errorf("%q: stack argument size mismatch; expected %d, got %d", g.name, g.argSize, argSize)
+		}
+	}
+}
+
+func TestSetArgSizes(t *testing.T) {
+	golden := []struct {
+		name         string
+		funcs        []Func
+		stdcallFuncs []StdcallFunc
+		// Stack argument sizes of functions.
+		want []int
+		err  string
+	}{
+		{
+			name:  "decorated",
+			funcs: []Func{{Name: "_Foo@12"}, {Name: "Foo@0"}, {Name: "Foo@x"}, {Name: "printf"}},
+			want:  []int{12, 0, 0, 0},
+		},
+		{
+			name:         "stdcall overrides decorated",
+			funcs:        []Func{{Name: "_Foo@12"}, {Name: "Bar"}},
+			stdcallFuncs: []StdcallFunc{{Name: "_Foo@12", ArgSize: 8}, {Name: "Bar", ArgSize: 4}},
+			want:         []int{8, 4},
+		},
+		{
+			name:         "stdcall duplicate",
+			funcs:        []Func{{Name: "Foo"}},
+			stdcallFuncs: []StdcallFunc{{Name: "Foo", ArgSize: 8}, {Name: "Foo", ArgSize: 8}},
+			want:         []int{8},
+		},
+		{
+			name:         "stdcall conflicting sizes",
+			funcs:        []Func{{Name: "Foo"}},
+			stdcallFuncs: []StdcallFunc{{Name: "Foo", ArgSize: 8}, {Name: "Foo", ArgSize: 12}},
+			err:          `conflicting stack argument sizes of function "Foo"; 8 and 12`,
+		},
+		{
+			name:  "decorated invalid size",
+			funcs: []Func{{Name: "_Foo@6"}},
+			err:   `invalid stack argument size of function "_Foo@6"; expected non-negative multiple of 4, got 6`,
+		},
+		{
+			name:         "stdcall invalid size",
+			funcs:        []Func{{Name: "Foo"}},
+			stdcallFuncs: []StdcallFunc{{Name: "Foo", ArgSize: -4}},
+			err:          `invalid stack argument size of function "Foo"; expected non-negative multiple of 4, got -4`,
+		},
+	}
+	for _, g := range golden {
+		libs := []Library{{Name: "foo", Funcs: g.funcs}}
+		err := setArgSizes(libs, g.stdcallFuncs)
+		if !checkErr(t, g.name, err, g.err) {
+			continue
+		}
+		for i, fn := range libs[0].Funcs {
+			if fn.ArgSize != g.want[i] {
+				t.Errorf("%s: stack argument size of function %q mismatch; expected %d, got %d", g.name, fn.Name, g.want[i], fn.ArgSize)
+			}
+		}
+	}
+}
+
+func TestSetArgSizesPrecedence(t *testing.T) {
+	// Prototype of __stdcall function of 8 bytes of stack arguments.
+	proto := &Proto{Ret: "int", Name: "foo", Stdcall: true, Params: []Param{{Type: "int", Name: "a"}, {Type: "int", Name: "b"}}}
+	golden := []struct {
+		name         string
+		fn           Func
+		stdcallFuncs []StdcallFunc
+		want         int
+	}{
+		{
+			name: "prototype",
+			fn:   Func{Name: "foo", Proto: proto},
+			want: 8,
+		},
+		{
+			name: "decorated name over prototype",
+			fn:   Func{Name: "_foo@12", Proto: proto},
+			want: 12,
+		},
+		{
+			name:         "stdcall over decorated name and prototype",
+			fn:           Func{Name: "_foo@12", Proto: proto},
+			stdcallFuncs: []StdcallFunc{{Name: "_foo@12", ArgSize: 16}},
+			want:         16,
+		},
+		{
+			name:         "stdcall __cdecl over prototype",
+			fn:           Func{Name: "foo", Proto: proto},
+			stdcallFuncs: []StdcallFunc{{Name: "foo", ArgSize: 0}},
+			want:         0,
+		},
+		{
+			name: "__cdecl prototype",
+			fn:   Func{Name: "foo", Proto: &Proto{Ret: "int", Name: "foo", Params: proto.Params}},
+			want: 0,
+		},
+	}
+	for _, g := range golden {
+		libs := []Library{{Name: "foo", Funcs: []Func{g.fn}}}
+		if err := setArgSizes(libs, g.stdcallFuncs); err != nil {
+			t.Errorf("%s: unable to set stack argument sizes; %v", g.name, err)
+			continue
+		}
+		if got := libs[0].Funcs[0].ArgSize; got != g.want {
+			t.Errorf("%s: stack argument size mismatch; expected %d, got %d", g.name, g.want, got)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package zelda
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Manifest is a machine-readable record of a relinked PE file, specifying
+// where generated code and data end up in the ELF file. Addresses which are
+// determined by NASM when assembling the NASM listing (e.g. of generated
+// segments, .plt entries and .got.plt entries) are only present after reading
+// the assembled ELF file.
+type Manifest struct {
+	// Path to PE file.
+	Input string `json:"input"`
+	// (optional) Path to NASM listing.
+	Output string `json:"output,omitempty"`
+	// (optional) Path to assembled ELF file.
+	ELF string `json:"elf,omitempty"`
+	// Address of entry point.
+	Entry Address `json:"entry"`
+	// Relinked into a shared library.
+	IsSharedLib bool `json:"shared_lib"`
+	// Loadable segments, in order of program headers.
+	Segments []ManifestSegment `json:"segments"`
+	// Shared libraries.
+	Libs []ManifestLib `json:"libs"`
+	// Entries of the import address tables, redirected to .plt entries.
+	IATSlots []IATSlot `json:"iat_slots"`
+	// Injection sites of statically linked functions.
+	StaticFuncs []ManifestStaticFunc `json:"static_funcs"`
+	// Hooked functions.
+	Hooks []ManifestHook `json:"hooks"`
+	// Patches of section contents, sorted by start address.
+	Patches []ManifestPatch `json:"patches"`
+	// Exported symbols.
+	Exports []ManifestExport `json:"exports"`
+}
+
+// ManifestSegment is a loadable segment of a relinked PE file.
+type ManifestSegment struct {
+	// Segment name; either a generated segment (r_seg, rw_seg or x_seg) or the
+	// sections of the PE file, separated by '+' (e.g. ".text+.rdata").
+	Name string `json:"name"`
+	// Virtual address of segment; or 0 if determined when assembling.
+	Addr Address `json:"addr,omitempty"`
+	// Size of segment in number of bytes; or 0 if determined when assembling.
+	Size int64 `json:"size,omitempty"`
+	// Access permissions of segment (e.g. "r-x").
+	Perm string `json:"perm"`
+}
+
+// ManifestLib is a shared library of a relinked PE file.
+type ManifestLib struct {
+	// Library file name.
+	Filename string `json:"filename"`
+	// (optional) DLL file name of imported library.
+	DLL string `json:"dll,omitempty"`
+	// Imported functions.
+	Funcs []ManifestFunc `json:"funcs"`
+}
+
+// ManifestFunc is an imported function of a relinked PE file.
+type ManifestFunc struct {
+	// Function name.
+	Name string `json:"name"`
+	// Size in bytes of the stack arguments of __stdcall functions; or 0 for
+	// __cdecl functions.
+	ArgSize int `json:"argsize,omitempty"`
+	// Address of .plt entry; or 0 if determined when assembling.
+	PLT Address `json:"plt,omitempty"`
+	// Address of .got.plt entry; or 0 if determined when assembling.
+	GOT Address `json:"got,omitempty"`
+}
+
+// ManifestStaticFunc is the injection site of a statically linked function,
+// which jumps to the .plt entry of the function of its dynamic library.
+type ManifestStaticFunc struct {
+	// Address of injection site.
+	Addr Address `json:"addr"`
+	// File name of dynamic library.
+	Lib string `json:"lib"`
+	// Function name.
+	Name string `json:"name"`
+}
+
+// ManifestHook is a hooked function of a relinked PE file.
+type ManifestHook struct {
+	// Address of hooked function.
+	Addr Address `json:"addr"`
+	// Function name.
+	Name string `json:"name"`
+	// Size in bytes of the overwritten prologue.
+	Size int `json:"size"`
+	// Name of trampoline through which the original function remains callable.
+	Trampoline string `json:"trampoline"`
+}
+
+// ManifestPatch is a patch of section contents.
+type ManifestPatch struct {
+	// Patch kind.
+	Kind string `json:"kind"`
+	// Start address, inclusive.
+	Start Address `json:"start"`
+	// End address, exclusive.
+	End Address `json:"end"`
+	// Origin of patch.
+	Origin string `json:"origin"`
+}
+
+// ManifestExport is an exported symbol of a relinked PE file.
+type ManifestExport struct {
+	// Symbol name.
+	Name string `json:"name"`
+	// Address of exported symbol; or 0 if determined when assembling (e.g. hook
+	// trampolines).
+	Addr Address `json:"addr,omitempty"`
+}
+
+// NewManifest returns the manifest of the given relink result of a PE file,
+// as relinked into the given NASM listing.
+func NewManifest(pePath, output string, res *Result) *Manifest {
+	m := &Manifest{
+		Input:       pePath,
+		Output:      output,
+		Entry:       res.Entry,
+		IsSharedLib: res.IsSharedLib,
+		IATSlots:    res.IATSlots,
+	}
+	// Segments.
+	m.Segments = []ManifestSegment{
+		{Name: "r_seg", Perm: PermR.String()},
+		{Name: "rw_seg", Perm: (PermR | PermW).String()},
+		{Name: "x_seg", Perm: (PermR | PermX).String()},
+	}
+	for _, seg := range res.Segments {
+		last := seg.Sects[len(seg.Sects)-1]
+		s := ManifestSegment{
+			Name: seg.Name(),
+			Addr: seg.Sects[0].Addr,
+			Size: int64(last.Addr-seg.Sects[0].Addr) + last.Size,
+			Perm: seg.Perm.String(),
+		}
+		m.Segments = append(m.Segments, s)
+	}
+	// Shared libraries.
+	for _, lib := range res.Libs {
+		l := ManifestLib{
+			Filename: lib.Filename,
+			DLL:      lib.DLL,
+		}
+		for _, fn := range lib.Funcs {
+			l.Funcs = append(l.Funcs, ManifestFunc{Name: fn.Name, ArgSize: fn.ArgSize})
+		}
+		m.Libs = append(m.Libs, l)
+	}
+	// Statically linked functions.
+	for _, staticLib := range res.StaticLibs {
+		for _, fn := range staticLib.Funcs {
+			staticFunc := ManifestStaticFunc{
+				Addr: fn.Addr,
+				Lib:  staticLib.Filename,
+				Name: fn.Name,
+			}
+			m.StaticFuncs = append(m.StaticFuncs, staticFunc)
+		}
+	}
+	// Hooked functions.
+	for _, hook := range res.Hooks {
+		h := ManifestHook{
+			Addr:       hook.Addr,
+			Name:       hook.Name,
+			Size:       hook.Size,
+			Trampoline: hook.OrigName(),
+		}
+		m.Hooks = append(m.Hooks, h)
+	}
+	// Patches.
+	for _, p := range res.Patches {
+		patch := ManifestPatch{
+			Kind:   p.Kind.String(),
+			Start:  p.Start,
+			End:    p.End,
+			Origin: p.Origin,
+		}
+		m.Patches = append(m.Patches, patch)
+	}
+	// Exported symbols.
+	for _, export := range res.Exports {
+		e := ManifestExport{Name: export.Name}
+		if len(export.Label) == 0 {
+			e.Addr = export.Addr
+		}
+		m.Exports = append(m.Exports, e)
+	}
+	return m
+}
+
+// ReadELF records the addresses determined by NASM when assembling the NASM
+// listing of the manifest into the given ELF file; the addresses and sizes of
+// segments, the addresses of .plt and .got.plt entries, and the addresses of
+// exported symbols.
+func (m *Manifest) ReadELF(elfPath string) error {
+	f, err := elf.Open(elfPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+	m.ELF = elfPath
+	// Segments.
+	var loads []*elf.Prog
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_LOAD {
+			loads = append(loads, prog)
+		}
+	}
+	if len(loads) != len(m.Segments) {
+		return errors.Errorf("mismatch between number of loadable segments of ELF file %q and manifest; expected %d, got %d", elfPath, len(m.Segments), len(loads))
+	}
+	for i, prog := range loads {
+		m.Segments[i].Addr = Address(prog.Vaddr)
+		m.Segments[i].Size = int64(prog.Memsz)
+	}
+	// Exported symbols.
+	syms, err := f.DynamicSymbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return errors.WithStack(err)
+	}
+	symAddrs := make(map[string]Address)
+	for _, sym := range syms {
+		if sym.Section != elf.SHN_UNDEF {
+			symAddrs[sym.Name] = Address(sym.Value)
+		}
+	}
+	for i := range m.Exports {
+		export := &m.Exports[i]
+		addr, ok := symAddrs[export.Name]
+		if !ok {
+			return errors.Errorf("unable to locate exported symbol %q in ELF file %q", export.Name, elfPath)
+		}
+		export.Addr = addr
+	}
+	// .plt and .got.plt entries.
+	if err := m.readPLT(f, syms); err != nil {
+		return errors.Wrapf(err, "unable to locate .plt entries of ELF file %q", elfPath)
+	}
+	return nil
+}
+
+// readPLT records the addresses of the .plt and .got.plt entries of the
+// imported functions, as located through the .rel.plt relocations of the given
+// ELF file.
+//
+// Each .got.plt entry initially holds the address of the lazy resolution stub
+// at the end of the .plt entry of its function. The first .plt entry follows the
+// resolver at the start of the .plt section, and each subsequent .plt entry
+// follows the lazy resolution stub of the preceding function; thus .plt entries
+// of any size are located (e.g. __stdcall thunks and traced calls). The
+// resolver and each lazy resolution stub are checked against their expected
+// instructions, as the layout of .plt entries may be changed by templates.
+func (m *Manifest) readPLT(f *elf.File, syms []elf.Symbol) error {
+	var funcs []*ManifestFunc
+	for i := range m.Libs {
+		lib := &m.Libs[i]
+		for j := range lib.Funcs {
+			funcs = append(funcs, &lib.Funcs[j])
+		}
+	}
+	if len(funcs) == 0 {
+		return nil
+	}
+	relPlt := f.Section(".rel.plt")
+	gotPlt := f.Section(".got.plt")
+	plt := f.Section(".plt")
+	if relPlt == nil || gotPlt == nil || plt == nil {
+		return errors.New("missing .rel.plt, .got.plt or .plt section")
+	}
+	rels, err := relPlt.Data()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	gots, err := gotPlt.Data()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	plts, err := plt.Data()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	const (
+		// Size of Elf32_Rel relocation.
+		relSize = 8
+		// Size of resolver at the start of the .plt section.
+		resolverSize = 12
+		// Size of lazy resolution stub of .plt entry.
+		resolveStubSize = 10
+	)
+	if len(rels) != relSize*len(funcs) {
+		return errors.Errorf("mismatch between number of .rel.plt relocations and imported functions; expected %d, got %d", len(funcs), len(rels)/relSize)
+	}
+	// push dword [got_plt.link_map]; jmp [got_plt.dl_runtime_resolve]
+	if len(plts) < resolverSize || plts[0] != 0xFF || plts[1] != 0x35 || plts[6] != 0xFF || plts[7] != 0x25 {
+		return errors.Errorf("unable to locate resolver at start of .plt section (address 0x%X)", plt.Addr)
+	}
+	pltAddr := Address(plt.Addr) + resolverSize
+	for i, fn := range funcs {
+		rel := rels[relSize*i:]
+		gotAddr := Address(binary.LittleEndian.Uint32(rel))
+		symIndex := int(elf.R_SYM32(binary.LittleEndian.Uint32(rel[4:])))
+		// The null symbol is omitted by DynamicSymbols.
+		if symIndex < 1 || symIndex > len(syms) || syms[symIndex-1].Name != fn.Name {
+			return errors.Errorf("mismatch between .rel.plt relocation %d and imported function %q", i, fn.Name)
+		}
+		off := uint64(gotAddr) - gotPlt.Addr
+		if uint64(gotAddr) < gotPlt.Addr || off+4 > uint64(len(gots)) {
+			return errors.Errorf("invalid .got.plt entry address %s of imported function %q", gotAddr, fn.Name)
+		}
+		// push dword rel_plt.NAME_off; jmp near plt.resolve
+		resolveAddr := Address(binary.LittleEndian.Uint32(gots[off:]))
+		stubOff := uint64(resolveAddr) - plt.Addr
+		if resolveAddr < pltAddr || stubOff+resolveStubSize > uint64(len(plts)) {
+			return errors.Errorf("invalid address %s of lazy resolution stub of imported function %q", resolveAddr, fn.Name)
+		}
+		stub := plts[stubOff : stubOff+resolveStubSize]
+		target := uint32(resolveAddr) + resolveStubSize + binary.LittleEndian.Uint32(stub[6:])
+		if stub[0] != 0x68 || binary.LittleEndian.Uint32(stub[1:]) != uint32(relSize*i) || stub[5] != 0xE9 || uint64(target) != plt.Addr {
+			return errors.Errorf("unexpected instructions of lazy resolution stub of imported function %q at address %s", fn.Name, resolveAddr)
+		}
+		fn.PLT = pltAddr
+		fn.GOT = gotAddr
+		pltAddr = resolveAddr + resolveStubSize
+	}
+	return nil
+}
+
+// Write writes the manifest in JSON format to w.
+func (m *Manifest) Write(w io.Writer) error {
+	buf, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	buf = append(buf, '\n')
+	if _, err := w.Write(buf); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
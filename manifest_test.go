@@ -0,0 +1,229 @@
+package zelda
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestNewManifest(t *testing.T) {
+	p := testPE{
+		imageBase: 0x400000,
+		entry:     0x1000,
+		sects: []testSect{
+			{name: ".text", relAddr: 0x1000, virtSize: 0x20, data: make([]byte, 0x20), flags: 0x60000020},
+		},
+		imps: []testImport{
+			{dll: "KERNEL32.dll", funcs: []string{"ExitProcess", "Sleep"}},
+			{dll: "msvcrt.dll", funcs: []string{"printf"}},
+		},
+	}
+	opts := Options{
+		Nops: AddrRanges{{Start: 0x401000, End: 0x401002}},
+		StaticLibs: []StaticLib{
+			{Filename: "libfoo.so", Funcs: []StaticFunc{{Addr: 0x401010, Name: "foo"}}},
+		},
+	}
+	_, res := p.relink(t, opts)
+	m := NewManifest("test.exe", "test.asm", res)
+	wantIATSlots := []IATSlot{
+		{Addr: 0x40203C, Lib: "kernel32.so", Func: "ExitProcess"},
+		{Addr: 0x402040, Lib: "kernel32.so", Func: "Sleep"},
+		{Addr: 0x402048, Lib: "msvcrt.so", Func: "printf"},
+	}
+	if !reflect.DeepEqual(m.IATSlots, wantIATSlots) {
+		t.Errorf("import address table entries mismatch; expected %v, got %v", wantIATSlots, m.IATSlots)
+	}
+	wantStaticFuncs := []ManifestStaticFunc{
+		{Addr: 0x401010, Lib: "libfoo.so", Name: "foo"},
+	}
+	if !reflect.DeepEqual(m.StaticFuncs, wantStaticFuncs) {
+		t.Errorf("statically linked functions mismatch; expected %v, got %v", wantStaticFuncs, m.StaticFuncs)
+	}
+	wantPatches := []ManifestPatch{
+		{Kind: "nop", Start: 0x401000, End: 0x401002, Origin: "-nop 0x401000-0x401002"},
+		{Kind: "static_lib", Start: 0x401010, End: 0x401015, Origin: "-static_libs libfoo.so: foo"},
+		{Kind: "imports", Start: 0x40203C, End: 0x402050, Origin: "import address table of PE file"},
+	}
+	if !reflect.DeepEqual(m.Patches, wantPatches) {
+		t.Errorf("patches mismatch; expected %v, got %v", wantPatches, m.Patches)
+	}
+	// Addresses of generated segments and .plt entries are determined when
+	// assembling.
+	wantLibs := []ManifestLib{
+		{Filename: "kernel32.so", DLL: "KERNEL32.dll", Funcs: []ManifestFunc{{Name: "ExitProcess", ArgSize: 4}, {Name: "Sleep", ArgSize: 4}}},
+		{Filename: "msvcrt.so", DLL: "msvcrt.dll", Funcs: []ManifestFunc{{Name: "printf"}}},
+		{Filename: "libfoo.so", Funcs: []ManifestFunc{{Name: "foo"}}},
+	}
+	if !reflect.DeepEqual(m.Libs, wantLibs) {
+		t.Errorf("shared libraries mismatch; expected %v, got %v", wantLibs, m.Libs)
+	}
+	wantSegs := []ManifestSegment{
+		{Name: "r_seg", Perm: "r--"},
+		{Name: "rw_seg", Perm: "rw-"},
+		{Name: "x_seg", Perm: "r-x"},
+		{Name: ".text", Addr: 0x401000, Size: 0x20, Perm: "rwx"},
+		{Name: ".idata", Addr: 0x402000, Size: res.Segments[1].Sects[0].Size, Perm: "rw-"},
+	}
+	if !reflect.DeepEqual(m.Segments, wantSegs) {
+		t.Errorf("segments mismatch; expected %v, got %v", wantSegs, m.Segments)
+	}
+}
+
+// testPLTEntry is a .plt entry of an imported function of a test ELF file.
+type testPLTEntry struct {
+	// Function name.
+	name string
+	// Size of .plt entry, excluding its lazy resolution stub.
+	size int
+}
+
+// testELF returns the contents of a test ELF file with .dynsym, .rel.plt,
+// .got.plt and .plt sections of the given imported functions, as output by the
+// default templates.
+func testELF(funcs []testPLTEntry) []byte {
+	const (
+		base         = 0x08000000
+		ehdrSize     = 52
+		resolverSize = 12
+		stubSize     = 10
+	)
+	le := binary.LittleEndian
+	// .dynstr and .dynsym.
+	dynstr := []byte{0}
+	dynsym := make([]byte, 16)
+	for _, fn := range funcs {
+		sym := make([]byte, 16)
+		le.PutUint32(sym, uint32(len(dynstr)))
+		sym[12] = byte(elf.STB_GLOBAL)<<4 | byte(elf.STT_FUNC)
+		dynsym = append(dynsym, sym...)
+		dynstr = append(dynstr, fn.name...)
+		dynstr = append(dynstr, 0)
+	}
+	// Section contents are stored in order, following the ELF header.
+	dynstrOff := ehdrSize
+	dynsymOff := dynstrOff + len(dynstr)
+	relPltOff := dynsymOff + len(dynsym)
+	gotPltOff := relPltOff + 8*len(funcs)
+	pltOff := gotPltOff + 4*(3+len(funcs))
+	relPlt := make([]byte, 8*len(funcs))
+	gotPlt := make([]byte, 4*(3+len(funcs)))
+	// push dword [got_plt.link_map]; jmp [got_plt.dl_runtime_resolve]
+	plt := []byte{0xFF, 0x35, 0, 0, 0, 0, 0xFF, 0x25, 0, 0, 0, 0}
+	for i, fn := range funcs {
+		gotAddr := base + gotPltOff + 4*(3+i)
+		le.PutUint32(relPlt[8*i:], uint32(gotAddr))
+		le.PutUint32(relPlt[8*i+4:], uint32(i+1)<<8|uint32(elf.R_386_JMP_SLOT))
+		plt = append(plt, bytes.Repeat([]byte{0x90}, fn.size)...)
+		resolveAddr := base + pltOff + len(plt)
+		le.PutUint32(gotPlt[4*(3+i):], uint32(resolveAddr))
+		// push dword rel_plt.NAME_off; jmp near plt.resolve
+		stub := []byte{0x68, 0, 0, 0, 0, 0xE9, 0, 0, 0, 0}
+		le.PutUint32(stub[1:], uint32(8*i))
+		le.PutUint32(stub[6:], uint32((base+pltOff)-(resolveAddr+stubSize)))
+		plt = append(plt, stub...)
+	}
+	shstrtab := []byte("\x00.dynstr\x00.dynsym\x00.rel.plt\x00.got.plt\x00.plt\x00.shstrtab\x00")
+	shstrtabOff := pltOff + len(plt)
+	shdrOff := shstrtabOff + len(shstrtab)
+	buf := &bytes.Buffer{}
+	write := func(v interface{}) {
+		if err := binary.Write(buf, le, v); err != nil {
+			panic(err)
+		}
+	}
+	// ELF header.
+	buf.Write([]byte{0x7F, 'E', 'L', 'F', byte(elf.ELFCLASS32), byte(elf.ELFDATA2LSB), byte(elf.EV_CURRENT), 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	write([]uint16{uint16(elf.ET_EXEC), uint16(elf.EM_386)})
+	write([]uint32{uint32(elf.EV_CURRENT), 0, 0, uint32(shdrOff), 0})
+	write([]uint16{ehdrSize, 0, 0, 40, 7, 6})
+	// Section contents.
+	for _, data := range [][]byte{dynstr, dynsym, relPlt, gotPlt, plt, shstrtab} {
+		buf.Write(data)
+	}
+	// Section headers.
+	shdr := func(name int, typ elf.SectionType, off, size, link, entsize int) {
+		addr := 0
+		if typ != elf.SHT_STRTAB || name == 1 {
+			addr = base + off
+		}
+		write([]uint32{uint32(name), uint32(typ), 0, uint32(addr), uint32(off), uint32(size), uint32(link), 0, 1, uint32(entsize)})
+	}
+	write(make([]uint32, 10))
+	shdr(1, elf.SHT_STRTAB, dynstrOff, len(dynstr), 0, 0)
+	shdr(9, elf.SHT_DYNSYM, dynsymOff, len(dynsym), 1, 16)
+	shdr(17, elf.SHT_REL, relPltOff, len(relPlt), 2, 8)
+	shdr(26, elf.SHT_PROGBITS, gotPltOff, len(gotPlt), 0, 4)
+	shdr(35, elf.SHT_PROGBITS, pltOff, len(plt), 0, 0)
+	shdr(40, elf.SHT_STRTAB, shstrtabOff, len(shstrtab), 0, 0)
+	return buf.Bytes()
+}
+
+func TestReadPLT(t *testing.T) {
+	// __cdecl function (jmp [got_plt.foo]), __stdcall thunk and traced
+	// __stdcall thunk.
+	funcs := []testPLTEntry{
+		{name: "foo", size: 6},
+		{name: "bar", size: 17},
+		{name: "baz", size: 32},
+	}
+	golden := []struct {
+		name string
+		// Modifies contents of test ELF file.
+		modify func(buf []byte)
+		want   []ManifestFunc
+		err    string
+	}{
+		{
+			name: "entries of different sizes",
+			want: []ManifestFunc{
+				{Name: "foo", PLT: 0x080000BD, GOT: 0x080000A5},
+				{Name: "bar", PLT: 0x080000CD, GOT: 0x080000A9},
+				{Name: "baz", PLT: 0x080000E8, GOT: 0x080000AD},
+			},
+		},
+		{
+			name: "missing resolver",
+			modify: func(buf []byte) {
+				// File offset of .plt section is 0xB1.
+				buf[0xB1+6] = 0x90
+			},
+			err: "unable to locate resolver at start of .plt section (address 0x80000B1)",
+		},
+		{
+			name: "unexpected lazy resolution stub",
+			modify: func(buf []byte) {
+				// Offset of .rel.plt relocation pushed by the stub of bar.
+				buf[0xB1+0x2D+1] = 0x10
+			},
+			err: `unexpected instructions of lazy resolution stub of imported function "bar" at address 0x80000DE`,
+		},
+	}
+	for _, g := range golden {
+		buf := testELF(funcs)
+		if g.modify != nil {
+			g.modify(buf)
+		}
+		f, err := elf.NewFile(bytes.NewReader(buf))
+		if err != nil {
+			t.Fatalf("%s: unable to parse test ELF file; %v", g.name, err)
+		}
+		syms, err := f.DynamicSymbols()
+		if err != nil {
+			t.Fatalf("%s: unable to parse dynamic symbols; %v", g.name, err)
+		}
+		m := &Manifest{Libs: []ManifestLib{{Filename: "libfoo.so"}}}
+		for _, fn := range funcs {
+			m.Libs[0].Funcs = append(m.Libs[0].Funcs, ManifestFunc{Name: fn.name})
+		}
+		err = m.readPLT(f, syms)
+		if !checkErr(t, g.name, err, g.err) {
+			continue
+		}
+		if !reflect.DeepEqual(m.Libs[0].Funcs, g.want) {
+			t.Errorf("%s: .plt entries mismatch; expected %v, got %v", g.name, g.want, m.Libs[0].Funcs)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package zelda
+
+// Default relink options.
+const (
+	// Default base address of the read-only segment; use 0x003XXXXX to prevent
+	// conflict with the 0x004XXXXX image base of PE files.
+	DefaultBase Address = 0x00300000
+	// Default number of stack arguments to output when tracing imported
+	// function calls.
+	DefaultTraceArgs = 4
+)
+
+// Options specifies how to relink a PE file.
+type Options struct {
+	// Path to output file; or empty to write to standard output.
+	Output string `json:"output"`
+	// Base address of the read-only segment.
+	Base Address `json:"base"`
+	// Address of entry point; or 0 to use the entry point of the PE file.
+	Entry Address `json:"entry"`
+	// Map the headers of the PE file (DOS header, NT headers and section
+	// headers) into a read-only segment at the image base.
+	MapHeaders bool `json:"map_headers"`
+	// Access permission policy of the loadable segments of PE sections.
+	PermPolicy PermPolicy `json:"perm_policy"`
+	// Names of sections made writable, regardless of access permission policy.
+	Writable SectionNames `json:"writable"`
+	// Bind imported functions at load time (BIND_NOW), instead of at first call.
+	BindNow bool `json:"bind_now"`
+	// Section rules, which drop, rename, relocate or override the access
+	// permissions of PE sections; applied after the access permission policy.
+	SectionRules []SectionRule `json:"sections"`
+	// Shared library file names (e.g. "libkernel32.so") of imported libraries,
+	// mapped from DLL file name (e.g. "KERNEL32.dll"). Imported libraries not
+	// present are mapped to "<name>.so" (e.g. "kernel32.so").
+	Libs map[string]string `json:"libs"`
+	// Interrupt address ranges.
+	Ints AddrRanges `json:"ints"`
+	// Nop address ranges.
+	Nops AddrRanges `json:"nops"`
+	// Binary replacements by address.
+	Replaces Replacements `json:"replaces"`
+	// Path to patch file (IPS, BPS, "cmp -l" output or patched PE file) of
+	// binary replacements by file offset.
+	PatchFile string `json:"patch_file"`
+	// Assembly patches by address range.
+	AsmPatches AsmPatches `json:"asm"`
+	// Patch kinds in order of decreasing priority, used to resolve overlapping
+	// patches; or nil to reject overlapping patches.
+	PatchPriority PatchKinds `json:"patch_priority"`
+	// Output a listing of all patches.
+	ExplainPatches bool `json:"explain_patches"`
+	// Exported symbols.
+	Exports []Export `json:"exports"`
+	// Statically linked libraries.
+	StaticLibs []StaticLib `json:"static_libs"`
+	// __stdcall functions and their stack argument sizes.
+	StdcallFuncs []StdcallFunc `json:"stdcall"`
+	// Path to prototype file of imported functions, overriding the bundled
+	// prototypes of Win32 functions.
+	ProtoFile string `json:"protos"`
+	// Hook libraries.
+	HookLibs []HookLib `json:"hooks"`
+	// Enter through a startup stub which emulates the Windows process entry;
+	// installing the TEB of the main thread through the FS segment register.
+	Startup bool `json:"startup"`
+	// Dispatch structured exceptions (SEH) of faulting instructions to the
+	// exception handlers of the FS:[0] chain, through the SEH runtime library
+	// (libzelda_seh.so) registered by the startup stub; requires Startup.
+	SEH bool `json:"seh"`
+	// Trace calls to imported functions.
+	TraceImports bool `json:"trace_imports"`
+	// Number of stack arguments to output when tracing calls to imported
+	// functions of unknown prototype.
+	TraceArgs int `json:"trace_args"`
+}
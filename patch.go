@@ -0,0 +1,445 @@
+package zelda
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// --- [ Patch kinds ] ---------------------------------------------------------
+
+// PatchKind specifies the kind of a patch.
+type PatchKind uint8
+
+// Patch kinds.
+const (
+	// PatchNop fills an address range with NOP instructions (or 0 bytes in
+	// non-executable sections).
+	PatchNop PatchKind = iota + 1
+	// PatchInt fills an address range with INT3 instructions.
+	PatchInt
+	// PatchReplace replaces the contents at an address.
+	PatchReplace
+	// PatchAsm replaces an address range with assembly instructions.
+	PatchAsm
+	// PatchStaticFunc replaces a statically linked function by a jump to its
+	// dynamically linked counterpart.
+	PatchStaticFunc
+	// PatchHook replaces the prologue of a hooked function by a jump to its
+	// hook.
+	PatchHook
+	// PatchImports redirects the import address table of the PE file to the
+	// .plt entries of the imported functions.
+	PatchImports
+)
+
+// patchKindNames maps from patch kind to patch kind name.
+var patchKindNames = map[PatchKind]string{
+	PatchNop:        "nop",
+	PatchInt:        "int",
+	PatchReplace:    "replace",
+	PatchAsm:        "asm",
+	PatchStaticFunc: "static_lib",
+	PatchHook:       "hook",
+	PatchImports:    "imports",
+}
+
+// String returns the string representation of the patch kind.
+func (kind PatchKind) String() string {
+	if s, ok := patchKindNames[kind]; ok {
+		return s
+	}
+	return fmt.Sprintf("PatchKind(%d)", uint8(kind))
+}
+
+// IsData reports whether the patch kind modifies the section contents directly,
+// as opposed to replacing section contents with generated code or data when
+// pretty-printing.
+func (kind PatchKind) IsData() bool {
+	switch kind {
+	case PatchNop, PatchInt, PatchReplace:
+		return true
+	}
+	return false
+}
+
+// PatchKinds is a list of patch kinds, in order of decreasing priority.
+type PatchKinds []PatchKind
+
+// Set sets the patch kinds based on the given comma-separated string (e.g.
+// "replace,int,nop"). Only patch kinds which modify section contents directly
+// may be specified.
+func (kinds *PatchKinds) Set(s string) error {
+	*kinds = nil
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for kind, kindName := range patchKindNames {
+			if kindName == name && kind.IsData() {
+				*kinds = append(*kinds, kind)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.Errorf("invalid patch kind %q; expected nop, int or replace", name)
+		}
+	}
+	return nil
+}
+
+// String returns the string representation of the patch kinds.
+func (kinds PatchKinds) String() string {
+	var ss []string
+	for _, kind := range kinds {
+		ss = append(ss, kind.String())
+	}
+	return strings.Join(ss, ",")
+}
+
+// UnmarshalText unmarshals the text into kinds.
+func (kinds *PatchKinds) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		// Reject overlapping patches.
+		*kinds = nil
+		return nil
+	}
+	return kinds.Set(string(text))
+}
+
+// MarshalText returns the textual representation of kinds.
+func (kinds PatchKinds) MarshalText() ([]byte, error) {
+	return []byte(kinds.String()), nil
+}
+
+// priority returns the priority of the given patch kind; higher is more
+// important. Patch kinds not present have the lowest priority.
+func (kinds PatchKinds) priority(kind PatchKind) int {
+	for i, k := range kinds {
+		if k == kind {
+			return len(kinds) - i
+		}
+	}
+	return 0
+}
+
+// --- [ Patches ] -------------------------------------------------------------
+
+// Patch is a modification of the contents of the address range [Start, End).
+type Patch struct {
+	// Patch kind.
+	Kind PatchKind
+	// Start address, inclusive.
+	Start Address
+	// End address, exclusive.
+	End Address
+	// Origin of patch (e.g. command line option or JSON file entry).
+	Origin string
+	// Replacement bytes of replace patches.
+	Buf []byte
+	// (optional) Expected original content.
+	Expect *Expected
+	// Number of bytes applied.
+	applied int
+	// Patches overriding parts of this patch, as resolved by priority.
+	overriddenBy []*Patch
+}
+
+// overlaps reports whether the patch overlaps with the given patch.
+func (p *Patch) overlaps(q *Patch) bool {
+	return p.Start < q.End && q.Start < p.End
+}
+
+// PatchPlan is the set of all modifications of section contents, with
+// overlapping patches either rejected or resolved by priority.
+type PatchPlan struct {
+	// Patches sorted by start address.
+	Patches []*Patch
+	// Patch kinds in order of decreasing priority, used to resolve overlapping
+	// patches; or nil to reject overlapping patches.
+	Priority PatchKinds
+}
+
+// newPatchPlan returns the patch plan of the given relink options, binary
+// replacements of patch file, statically linked function injection sites, hook
+// sites and import address table.
+func newPatchPlan(opts Options, fileReplaces Replacements, hooks []Hook, libImps AddrRange) *PatchPlan {
+	plan := &PatchPlan{
+		Priority: opts.PatchPriority,
+	}
+	add := func(p *Patch) {
+		plan.Patches = append(plan.Patches, p)
+	}
+	for _, nop := range opts.Nops {
+		add(&Patch{Kind: PatchNop, Start: nop.Start, End: nop.End, Origin: "-nop " + nop.String(), Expect: nop.Expect})
+	}
+	for _, i := range opts.Ints {
+		add(&Patch{Kind: PatchInt, Start: i.Start, End: i.End, Origin: "-int " + i.String(), Expect: i.Expect})
+	}
+	for _, replace := range opts.Replaces {
+		end := replace.Addr + Address(len(replace.Buf))
+		add(&Patch{Kind: PatchReplace, Start: replace.Addr, End: end, Origin: "-replace " + replace.String(), Buf: replace.Buf, Expect: replace.Expect})
+	}
+	for _, replace := range fileReplaces {
+		end := replace.Addr + Address(len(replace.Buf))
+		origin := fmt.Sprintf("-patch_file %s: %s", opts.PatchFile, replace.String())
+		add(&Patch{Kind: PatchReplace, Start: replace.Addr, End: end, Origin: origin, Buf: replace.Buf, Expect: replace.Expect})
+	}
+	for _, patch := range opts.AsmPatches {
+		add(&Patch{Kind: PatchAsm, Start: patch.Range.Start, End: patch.Range.End, Origin: "-asm " + patch.String(), Expect: patch.Range.Expect})
+	}
+	for _, staticLib := range opts.StaticLibs {
+		for _, fn := range staticLib.Funcs {
+			origin := fmt.Sprintf("-static_libs %s: %s", staticLib.Filename, fn.Name)
+			add(&Patch{Kind: PatchStaticFunc, Start: fn.Addr, End: fn.Addr + jmpSize, Origin: origin})
+		}
+	}
+	for _, hookLib := range opts.HookLibs {
+		for _, fn := range hookLib.Funcs {
+			for _, hook := range hooks {
+				if hook.Addr == fn.Addr && hook.Name == fn.Name {
+					origin := fmt.Sprintf("-hooks %s: %s", hookLib.Filename, fn.Name)
+					add(&Patch{Kind: PatchHook, Start: hook.Addr, End: hook.Addr + Address(hook.Size), Origin: origin})
+					break
+				}
+			}
+		}
+	}
+	if libImps.Start < libImps.End {
+		add(&Patch{Kind: PatchImports, Start: libImps.Start, End: libImps.End, Origin: "import address table of PE file"})
+	}
+	sort.SliceStable(plan.Patches, func(i, j int) bool {
+		return plan.Patches[i].Start < plan.Patches[j].Start
+	})
+	return plan
+}
+
+// check checks the original content of each patched address range against its
+// expected content, if specified. The returned error lists every mismatch.
+func (plan *PatchPlan) check(sects []*Section) error {
+	e := &PatchError{Msg: "original content mismatch"}
+	for _, p := range plan.Patches {
+		if p.Expect == nil {
+			continue
+		}
+		actual, err := readRange(sects, p.Start, p.End)
+		if err != nil {
+			e.add(p, errors.Wrapf(err, "unable to check %s patch", p.Kind).Error())
+			continue
+		}
+		if err := p.Expect.Check(p.Start, actual); err != nil {
+			e.add(p, errors.Wrapf(err, "%s patch %s-%s", p.Kind, p.Start, p.End).Error())
+		}
+	}
+	if len(e.Problems) > 0 {
+		return errors.WithStack(e)
+	}
+	return nil
+}
+
+// resolve detects overlapping patches. Overlapping patches which modify section
+// contents directly are resolved by priority, if specified. The returned error
+// lists every unresolved overlap.
+func (plan *PatchPlan) resolve() error {
+	e := &PatchError{Msg: "overlapping patches"}
+	for i, p := range plan.Patches {
+		for _, q := range plan.Patches[i+1:] {
+			if q.Start >= p.End {
+				// Patches are sorted by start address.
+				break
+			}
+			if !p.overlaps(q) {
+				continue
+			}
+			if p.Kind.IsData() && q.Kind.IsData() && len(plan.Priority) > 0 {
+				pp, qp := plan.Priority.priority(p.Kind), plan.Priority.priority(q.Kind)
+				switch {
+				case pp > qp:
+					q.overriddenBy = append(q.overriddenBy, p)
+					continue
+				case qp > pp:
+					p.overriddenBy = append(p.overriddenBy, q)
+					continue
+				}
+			}
+			e.add(p, fmt.Sprintf("%s patch %s-%s (%s) overlaps %s patch %s-%s (%s)", p.Kind, p.Start, p.End, p.Origin, q.Kind, q.Start, q.End, q.Origin))
+		}
+	}
+	if len(e.Problems) > 0 {
+		return errors.WithStack(e)
+	}
+	return nil
+}
+
+// apply applies the patches which modify section contents directly to the
+// given section, in order of increasing priority. Each patched byte is logged
+// to logger.
+func (plan *PatchPlan) apply(sect *Section, logger *log.Logger) {
+	var patches []*Patch
+	for _, p := range plan.Patches {
+		if p.Kind.IsData() {
+			patches = append(patches, p)
+		}
+	}
+	sort.SliceStable(patches, func(i, j int) bool {
+		return plan.Priority.priority(patches[i].Kind) < plan.Priority.priority(patches[j].Kind)
+	})
+	for _, p := range patches {
+		switch p.Kind {
+		case PatchNop:
+			b := byte(0x00) // 0 byte.
+			if sect.Perm&PermX != 0 {
+				b = byte(0x90) // NOP instruction
+			}
+			p.applied += sect.fill(AddrRange{Start: p.Start, End: p.End}, b, logger)
+		case PatchInt:
+			if sect.Perm&PermX != 0 {
+				b := byte(0xCC) // INT3 instruction
+				p.applied += sect.fill(AddrRange{Start: p.Start, End: p.End}, b, logger)
+			}
+		case PatchReplace:
+			p.applied += sect.replace(p.Start, p.Buf, logger)
+		}
+	}
+}
+
+// track returns a pretty-printer which records the patches of the given kind
+// applied by the pretty-printer f.
+func (plan *PatchPlan) track(kind PatchKind, f func(w io.Writer, addr Address, buf []byte) (int, error)) func(w io.Writer, addr Address, buf []byte) (int, error) {
+	return func(w io.Writer, addr Address, buf []byte) (int, error) {
+		n, err := f(w, addr, buf)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		if n > 0 {
+			for _, p := range plan.Patches {
+				if p.Kind == kind && p.Start == addr {
+					p.applied += n
+					break
+				}
+			}
+		}
+		return n, nil
+	}
+}
+
+// checkApplied checks that every byte of each patch was applied. The returned
+// error lists every unapplied and partially applied patch.
+func (plan *PatchPlan) checkApplied(sects []*Section) error {
+	e := &PatchError{Msg: "unable to apply patches"}
+	for _, p := range plan.Patches {
+		total := int(p.End - p.Start)
+		if p.applied == total {
+			continue
+		}
+		var reasons []string
+		for _, sect := range sects {
+			if sect.uninit(p.Start, p.End) {
+				reasons = append(reasons, fmt.Sprintf("overlaps uninitialized data of section %q", sect.Name))
+			}
+			sectEnd := sect.Addr + Address(len(sect.Data))
+			if p.Kind == PatchInt && sect.Perm&PermX == 0 && p.Start < sectEnd && sect.Addr < p.End {
+				reasons = append(reasons, fmt.Sprintf("overlaps non-executable section %q", sect.Name))
+			}
+		}
+		var msg string
+		switch {
+		case p.applied == 0:
+			msg = fmt.Sprintf("%s patch %s-%s (%s) not applied", p.Kind, p.Start, p.End, p.Origin)
+		default:
+			msg = fmt.Sprintf("%s patch %s-%s (%s) partially applied (%d of %d bytes)", p.Kind, p.Start, p.End, p.Origin, p.applied, total)
+		}
+		if len(reasons) > 0 {
+			msg += "; " + strings.Join(reasons, "; ")
+		}
+		e.add(p, msg)
+	}
+	if len(e.Problems) > 0 {
+		return errors.WithStack(e)
+	}
+	return nil
+}
+
+// explain outputs a listing of the patch plan, writing to w.
+func (plan *PatchPlan) explain(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "patch plan (%d patches):\n", len(plan.Patches)); err != nil {
+		return errors.WithStack(err)
+	}
+	for _, p := range plan.Patches {
+		if _, err := fmt.Fprintf(w, "  0x%08X-0x%08X  %-10s  %s\n", uint64(p.Start), uint64(p.End), p.Kind, p.Origin); err != nil {
+			return errors.WithStack(err)
+		}
+		for _, q := range p.overriddenBy {
+			start, end := q.Start, q.End
+			if start < p.Start {
+				start = p.Start
+			}
+			if end > p.End {
+				end = p.End
+			}
+			if _, err := fmt.Fprintf(w, "      0x%08X-0x%08X overridden by %s patch (%s)\n", uint64(start), uint64(end), q.Kind, q.Origin); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+	return nil
+}
+
+// --- [ Patch errors ] --------------------------------------------------------
+
+// PatchError is an error of one or more patches, as returned when the original
+// content of patches mismatch, when patches overlap, or when patches could not
+// be applied. The underlying *PatchError of errors returned by Relink and
+// PatchPE is accessible through errors.Cause of github.com/pkg/errors.
+type PatchError struct {
+	// Description of error.
+	Msg string
+	// Problems of each offending patch.
+	Problems []PatchProblem
+}
+
+// PatchProblem is a problem of a patch.
+type PatchProblem struct {
+	// Offending patch.
+	Patch *Patch
+	// Description of problem.
+	Msg string
+}
+
+// add adds the problem of the given patch to the patch error.
+func (e *PatchError) add(p *Patch, msg string) {
+	e.Problems = append(e.Problems, PatchProblem{Patch: p, Msg: msg})
+}
+
+// Error returns the error message of the patch error, listing the problem of
+// each offending patch.
+func (e *PatchError) Error() string {
+	var msgs []string
+	for _, problem := range e.Problems {
+		msgs = append(msgs, problem.Msg)
+	}
+	return fmt.Sprintf("%s (%d patches):\n%s", e.Msg, len(e.Problems), strings.Join(msgs, "\n"))
+}
+
+// readRange returns the initialized section contents of the given address
+// range [start, end).
+func readRange(sects []*Section, start, end Address) ([]byte, error) {
+	var buf []byte
+	for addr := start; addr < end; {
+		data, ok := sectData(sects, addr)
+		if !ok {
+			return nil, errors.Errorf("address %s not within initialized section contents", addr)
+		}
+		n := end - addr
+		if Address(len(data)) < n {
+			n = Address(len(data))
+		}
+		buf = append(buf, data[:n]...)
+		addr += n
+	}
+	return buf, nil
+}
@@ -0,0 +1,140 @@
+package zelda
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// patchProblems returns the problems of the given patch error, one per line
+// following the error message.
+func patchProblems(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	lines := strings.Split(err.Error(), "\n")
+	return lines[1:]
+}
+
+func TestPatchPlanResolve(t *testing.T) {
+	golden := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{
+			name: "disjoint",
+			opts: Options{
+				Nops:     AddrRanges{{Start: 0x401000, End: 0x401002}},
+				Ints:     AddrRanges{{Start: 0x401002, End: 0x401004}},
+				Replaces: Replacements{{Addr: 0x401004, Buf: []byte{0xC3}}},
+			},
+		},
+		{
+			name: "overlapping",
+			opts: Options{
+				Nops:     AddrRanges{{Start: 0x401000, End: 0x401004}},
+				Replaces: Replacements{{Addr: 0x401003, Buf: []byte{0xC3, 0xC3}}},
+			},
+			want: []string{"nop patch 0x401000-0x401004 (-nop 0x401000-0x401004) overlaps replace patch 0x401003-0x401005 (-replace 0x401003:C3C3)"},
+		},
+		{
+			name: "resolved by priority",
+			opts: Options{
+				Nops:          AddrRanges{{Start: 0x401000, End: 0x401004}},
+				Replaces:      Replacements{{Addr: 0x401003, Buf: []byte{0xC3, 0xC3}}},
+				PatchPriority: PatchKinds{PatchReplace, PatchNop},
+			},
+		},
+		{
+			name: "same priority",
+			opts: Options{
+				Nops:          AddrRanges{{Start: 0x401000, End: 0x401004}, {Start: 0x401002, End: 0x401006}},
+				PatchPriority: PatchKinds{PatchReplace, PatchNop},
+			},
+			want: []string{"nop patch 0x401000-0x401004 (-nop 0x401000-0x401004) overlaps nop patch 0x401002-0x401006 (-nop 0x401002-0x401006)"},
+		},
+		{
+			name: "not resolved by priority",
+			opts: Options{
+				Nops: AddrRanges{{Start: 0x402000, End: 0x402004}},
+				StaticLibs: []StaticLib{
+					{Filename: "libfoo.so", Funcs: []StaticFunc{{Name: "foo", Addr: 0x402000}}},
+				},
+				PatchPriority: PatchKinds{PatchNop},
+			},
+			want: []string{"nop patch 0x402000-0x402004 (-nop 0x402000-0x402004) overlaps static_lib patch 0x402000-0x402005 (-static_libs libfoo.so: foo)"},
+		},
+		{
+			name: "import address table",
+			opts: Options{
+				Replaces: Replacements{{Addr: 0x403004, Buf: []byte{0x00}}},
+			},
+			want: []string{"imports patch 0x403000-0x403010 (import address table of PE file) overlaps replace patch 0x403004-0x403005 (-replace 0x403004:00)"},
+		},
+	}
+	for _, g := range golden {
+		plan := newPatchPlan(g.opts, nil, nil, AddrRange{Start: 0x403000, End: 0x403010})
+		got := patchProblems(t, plan.resolve())
+		if !reflect.DeepEqual(got, g.want) {
+			t.Errorf("%s: problems mismatch; expected %q, got %q", g.name, g.want, got)
+		}
+	}
+}
+
+func TestPatchPlanCheckApplied(t *testing.T) {
+	golden := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{
+			name: "applied",
+			opts: Options{
+				Nops:     AddrRanges{{Start: 0x401000, End: 0x401002}},
+				Ints:     AddrRanges{{Start: 0x401002, End: 0x401004}},
+				Replaces: Replacements{{Addr: 0x402000, Buf: []byte{0x41, 0x42}}},
+			},
+		},
+		{
+			name: "outside sections",
+			opts: Options{
+				Nops: AddrRanges{{Start: 0x405000, End: 0x405002}},
+			},
+			want: []string{"nop patch 0x405000-0x405002 (-nop 0x405000-0x405002) not applied"},
+		},
+		{
+			name: "uninitialized data",
+			opts: Options{
+				Replaces: Replacements{{Addr: 0x4020FF, Buf: []byte{0x41, 0x42}}},
+			},
+			want: []string{`replace patch 0x4020FF-0x402101 (-replace 0x4020FF:4142) partially applied (1 of 2 bytes); overlaps uninitialized data of section ".data"`},
+		},
+		{
+			name: "non-executable int",
+			opts: Options{
+				Ints: AddrRanges{{Start: 0x402000, End: 0x402002}},
+			},
+			want: []string{`int patch 0x402000-0x402002 (-int 0x402000-0x402002) not applied; overlaps non-executable section ".data"`},
+		},
+	}
+	for _, g := range golden {
+		sects := []*Section{
+			sect(".text", 0x401000, 0x100, 0x100, PermR|PermX),
+			sect(".data", 0x402000, 0x100, 0x200, PermR|PermW),
+		}
+		plan := newPatchPlan(g.opts, nil, nil, AddrRange{})
+		if err := plan.resolve(); err != nil {
+			t.Errorf("%s: unable to resolve patches; %v", g.name, err)
+			continue
+		}
+		for _, sect := range sects {
+			plan.apply(sect, discard)
+		}
+		got := patchProblems(t, plan.checkApplied(sects))
+		if !reflect.DeepEqual(got, g.want) {
+			t.Errorf("%s: problems mismatch; expected %q, got %q", g.name, g.want, got)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package zelda
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/mewmew/pe"
+	"github.com/pkg/errors"
+)
+
+// fileReplacement is a binary replacement specified by file offset.
+type fileReplacement struct {
+	// File offset of binary replacement.
+	Offset int64
+	// New content.
+	Buf []byte
+	// (optional) Expected original content.
+	Expect []byte
+}
+
+// parsePatchFile parses the given patch file into binary replacements of the
+// original PE file. Supported patch file formats are IPS, BPS, the output of
+// "cmp -l" and patched PE files; the format is identified by the contents of
+// the patch file. Differing bytes of patched PE files outside of section
+// contents (e.g. in the headers) are skipped and logged to logger.
+func parsePatchFile(patchPath string, file *pe.File, logger *log.Logger) (Replacements, error) {
+	buf, err := ioutil.ReadFile(patchPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var frs []fileReplacement
+	switch {
+	case bytes.HasPrefix(buf, []byte("PATCH")):
+		frs, err = parseIPS(buf)
+	case bytes.HasPrefix(buf, []byte("BPS1")):
+		frs, err = parseBPS(buf, file.Content)
+	case bytes.HasPrefix(buf, []byte("MZ")):
+		frs, err = diffFiles(file.Content, buf)
+		if err == nil {
+			frs = skipNonSectBytes(file, frs, logger)
+		}
+	default:
+		frs, err = parseCmp(buf)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse patch file %q", patchPath)
+	}
+	return fileReplacementsToVAs(file, frs)
+}
+
+// skipNonSectBytes returns the binary replacements within the section contents
+// of the PE file, splitting binary replacements at section boundaries. The file
+// offsets of skipped bytes are logged to logger.
+func skipNonSectBytes(file *pe.File, frs []fileReplacement, logger *log.Logger) []fileReplacement {
+	var kept []fileReplacement
+	for _, fr := range frs {
+		for i := 0; i < len(fr.Buf); {
+			offset := fr.Offset + int64(i)
+			_, ok := findSectHdr(file, offset)
+			// Length of run of bytes either within or outside of section contents.
+			n := 1
+			for i+n < len(fr.Buf) {
+				if _, ok2 := findSectHdr(file, offset+int64(n)); ok2 != ok {
+					break
+				}
+				n++
+			}
+			if ok {
+				kept = append(kept, fileReplacement{Offset: offset, Buf: fr.Buf[i : i+n], Expect: fr.Expect[i : i+n]})
+			} else {
+				logger.Printf("skipping %d differing bytes at file offset 0x%X of patched PE file; not within section contents", n, offset)
+			}
+			i += n
+		}
+	}
+	return kept
+}
+
+// fileReplacementsToVAs converts the given binary replacements from file
+// offsets to virtual addresses, based on the section headers of the PE file.
+// Binary replacements spanning several sections are split.
+func fileReplacementsToVAs(file *pe.File, frs []fileReplacement) (Replacements, error) {
+	var rs Replacements
+	for _, fr := range frs {
+		if fr.Offset < 0 || fr.Offset+int64(len(fr.Buf)) > int64(len(file.Content)) {
+			return nil, errors.Errorf("binary replacement at file offset 0x%X (%d bytes) outside of PE file (%d bytes)", fr.Offset, len(fr.Buf), len(file.Content))
+		}
+		for i := 0; i < len(fr.Buf); {
+			offset := fr.Offset + int64(i)
+			sectHdr, ok := findSectHdr(file, offset)
+			if !ok {
+				return nil, errors.Errorf("binary replacement at file offset 0x%X not within section contents of PE file", offset)
+			}
+			n := int64(sectHdr.DataOffset+sectHdr.DataSize) - offset
+			if rest := int64(len(fr.Buf) - i); rest < n {
+				n = rest
+			}
+			addr := Address(file.OptHdr.ImageBase) + Address(sectHdr.RelAddr) + Address(offset-int64(sectHdr.DataOffset))
+			r := Replacement{
+				Addr: addr,
+				Buf:  fr.Buf[i : i+int(n)],
+			}
+			if fr.Expect != nil {
+				r.Expect = &Expected{Buf: fr.Expect[i : i+int(n)]}
+			}
+			rs = append(rs, r)
+			i += int(n)
+		}
+	}
+	return rs, nil
+}
+
+// findSectHdr returns the header of the section containing the given file
+// offset. The boolean return value indicates success.
+func findSectHdr(file *pe.File, offset int64) (pe.SectionHeader, bool) {
+	for _, sectHdr := range file.SectHdrs {
+		start := int64(sectHdr.DataOffset)
+		end := start + int64(sectHdr.DataSize)
+		if start <= offset && offset < end {
+			return sectHdr, true
+		}
+	}
+	return pe.SectionHeader{}, false
+}
+
+// --- [ IPS ] -----------------------------------------------------------------
+
+// parseIPS parses the given IPS patch.
+//
+// ref: http://www.smwiki.net/wiki/IPS_file_format
+func parseIPS(buf []byte) ([]fileReplacement, error) {
+	const magic = "PATCH"
+	buf = buf[len(magic):]
+	var frs []fileReplacement
+	for {
+		if len(buf) < 3 {
+			return nil, errors.New("invalid IPS patch; missing EOF marker")
+		}
+		if string(buf[:3]) == "EOF" {
+			// Ignore optional truncation size.
+			return frs, nil
+		}
+		if len(buf) < 5 {
+			return nil, errors.New("invalid IPS patch; truncated record header")
+		}
+		offset := int64(buf[0])<<16 | int64(buf[1])<<8 | int64(buf[2])
+		size := int(binary.BigEndian.Uint16(buf[3:5]))
+		buf = buf[5:]
+		var data []byte
+		if size == 0 {
+			// Run-length encoded record.
+			if len(buf) < 3 {
+				return nil, errors.Errorf("invalid IPS patch; truncated RLE record at offset 0x%X", offset)
+			}
+			n := int(binary.BigEndian.Uint16(buf[:2]))
+			data = bytes.Repeat(buf[2:3], n)
+			buf = buf[3:]
+		} else {
+			if len(buf) < size {
+				return nil, errors.Errorf("invalid IPS patch; truncated record at offset 0x%X", offset)
+			}
+			data = buf[:size]
+			buf = buf[size:]
+		}
+		frs = append(frs, fileReplacement{Offset: offset, Buf: data})
+	}
+}
+
+// --- [ BPS ] -----------------------------------------------------------------
+
+// parseBPS parses the given BPS patch of the original file contents.
+//
+// ref: https://www.romhacking.net/documents/746/
+func parseBPS(buf, source []byte) ([]fileReplacement, error) {
+	const (
+		magic      = "BPS1"
+		footerSize = 3 * 4 // source, target and patch CRC32 checksums.
+	)
+	if len(buf) < len(magic)+footerSize {
+		return nil, errors.New("invalid BPS patch; truncated patch")
+	}
+	footer := buf[len(buf)-footerSize:]
+	sourceCRC := binary.LittleEndian.Uint32(footer[0:4])
+	targetCRC := binary.LittleEndian.Uint32(footer[4:8])
+	patchCRC := binary.LittleEndian.Uint32(footer[8:12])
+	if crc := crc32.ChecksumIEEE(buf[:len(buf)-4]); crc != patchCRC {
+		return nil, errors.Errorf("invalid BPS patch; patch checksum mismatch; expected 0x%08X, got 0x%08X", patchCRC, crc)
+	}
+	if crc := crc32.ChecksumIEEE(source); crc != sourceCRC {
+		return nil, errors.Errorf("BPS patch not applicable to PE file; source checksum mismatch; expected 0x%08X, got 0x%08X", sourceCRC, crc)
+	}
+	r := &bpsReader{buf: buf[len(magic) : len(buf)-footerSize]}
+	sourceSize := r.number()
+	targetSize := r.number()
+	metadataSize := r.number()
+	if r.err != nil {
+		return nil, errors.WithStack(r.err)
+	}
+	if sourceSize != uint64(len(source)) {
+		return nil, errors.Errorf("BPS patch not applicable to PE file; source size mismatch; expected %d bytes, got %d bytes", sourceSize, len(source))
+	}
+	if targetSize != sourceSize {
+		return nil, errors.Errorf("BPS patch changes file size from %d to %d bytes; only in-place binary replacements supported", sourceSize, targetSize)
+	}
+	if metadataSize > uint64(len(r.buf)) {
+		return nil, errors.New("invalid BPS patch; truncated metadata")
+	}
+	r.buf = r.buf[metadataSize:]
+	// Actions.
+	const (
+		sourceRead = iota
+		targetRead
+		sourceCopy
+		targetCopy
+	)
+	target := make([]byte, 0, targetSize)
+	var sourceRelOffset, targetRelOffset int64
+	for len(r.buf) > 0 && r.err == nil {
+		data := r.number()
+		length := int64(data>>2) + 1
+		outOffset := int64(len(target))
+		if outOffset+length > int64(targetSize) {
+			return nil, errors.New("invalid BPS patch; action exceeds target size")
+		}
+		switch data & 3 {
+		case sourceRead:
+			target = append(target, source[outOffset:outOffset+length]...)
+		case targetRead:
+			target = append(target, r.bytes(int(length))...)
+		case sourceCopy:
+			sourceRelOffset += r.offset()
+			if sourceRelOffset < 0 || sourceRelOffset+length > int64(len(source)) {
+				return nil, errors.New("invalid BPS patch; source copy out of bounds")
+			}
+			target = append(target, source[sourceRelOffset:sourceRelOffset+length]...)
+			sourceRelOffset += length
+		case targetCopy:
+			targetRelOffset += r.offset()
+			if targetRelOffset < 0 || targetRelOffset >= outOffset {
+				return nil, errors.New("invalid BPS patch; target copy out of bounds")
+			}
+			// Copy byte by byte, as the source and destination may overlap.
+			for i := int64(0); i < length; i++ {
+				target = append(target, target[targetRelOffset])
+				targetRelOffset++
+			}
+		}
+	}
+	if r.err != nil {
+		return nil, errors.WithStack(r.err)
+	}
+	if crc := crc32.ChecksumIEEE(target); crc != targetCRC {
+		return nil, errors.Errorf("invalid BPS patch; target checksum mismatch; expected 0x%08X, got 0x%08X", targetCRC, crc)
+	}
+	return diffFiles(source, target)
+}
+
+// bpsReader reads variable-length encoded numbers and data of BPS patches.
+type bpsReader struct {
+	// Unread contents of BPS patch.
+	buf []byte
+	// First error encountered.
+	err error
+}
+
+// number reads a variable-length encoded number.
+func (r *bpsReader) number() uint64 {
+	var data uint64
+	shift := uint64(1)
+	for {
+		if len(r.buf) == 0 {
+			if r.err == nil {
+				r.err = errors.New("invalid BPS patch; truncated number")
+			}
+			return 0
+		}
+		x := r.buf[0]
+		r.buf = r.buf[1:]
+		data += uint64(x&0x7F) * shift
+		if x&0x80 != 0 {
+			return data
+		}
+		shift <<= 7
+		data += shift
+	}
+}
+
+// offset reads a variable-length encoded signed relative offset.
+func (r *bpsReader) offset() int64 {
+	data := r.number()
+	offset := int64(data >> 1)
+	if data&1 != 0 {
+		return -offset
+	}
+	return offset
+}
+
+// bytes reads n bytes.
+func (r *bpsReader) bytes(n int) []byte {
+	if len(r.buf) < n {
+		if r.err == nil {
+			r.err = errors.New("invalid BPS patch; truncated data")
+		}
+		n = len(r.buf)
+	}
+	buf := r.buf[:n]
+	r.buf = r.buf[n:]
+	return buf
+}
+
+// --- [ cmp -l ] --------------------------------------------------------------
+
+// parseCmp parses the output of "cmp -l original patched", which lists each
+// differing byte as a 1-based decimal file offset followed by the original and
+// patched byte values in octal.
+func parseCmp(buf []byte) ([]fileReplacement, error) {
+	var frs []fileReplacement
+	s := bufio.NewScanner(bytes.NewReader(buf))
+	for lineNum := 1; s.Scan(); lineNum++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, errors.Errorf("invalid number of fields on line %d of \"cmp -l\" output; expected 3, got %d", lineNum, len(fields))
+		}
+		pos, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid file offset on line %d of \"cmp -l\" output", lineNum)
+		}
+		if pos < 1 {
+			return nil, errors.Errorf("invalid file offset on line %d of \"cmp -l\" output; expected >= 1, got %d", lineNum, pos)
+		}
+		old, err := strconv.ParseUint(fields[1], 8, 8)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid original byte on line %d of \"cmp -l\" output", lineNum)
+		}
+		new, err := strconv.ParseUint(fields[2], 8, 8)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid patched byte on line %d of \"cmp -l\" output", lineNum)
+		}
+		frs = appendByte(frs, pos-1, byte(new), byte(old))
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return frs, nil
+}
+
+// --- [ Patched files ] -------------------------------------------------------
+
+// diffFiles returns the binary replacements of the differing bytes between the
+// original and patched file contents.
+func diffFiles(orig, patched []byte) ([]fileReplacement, error) {
+	if len(orig) != len(patched) {
+		return nil, errors.Errorf("size mismatch between original (%d bytes) and patched file (%d bytes); only in-place binary replacements supported", len(orig), len(patched))
+	}
+	var frs []fileReplacement
+	for i := range orig {
+		if orig[i] != patched[i] {
+			frs = appendByte(frs, int64(i), patched[i], orig[i])
+		}
+	}
+	return frs, nil
+}
+
+// appendByte appends the binary replacement of the byte at the given file
+// offset, merging adjacent binary replacements.
+func appendByte(frs []fileReplacement, offset int64, new, old byte) []fileReplacement {
+	if len(frs) > 0 {
+		last := &frs[len(frs)-1]
+		if last.Offset+int64(len(last.Buf)) == offset {
+			last.Buf = append(last.Buf, new)
+			last.Expect = append(last.Expect, old)
+			return frs
+		}
+	}
+	fr := fileReplacement{
+		Offset: offset,
+		Buf:    []byte{new},
+		Expect: []byte{old},
+	}
+	return append(frs, fr)
+}
@@ -0,0 +1,282 @@
+package zelda
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseIPS(t *testing.T) {
+	golden := []struct {
+		name  string
+		patch string
+		want  []fileReplacement
+		err   string
+	}{
+		{
+			name:  "records",
+			patch: "PATCH" + "\x00\x00\x04\x00\x02AB" + "\x01\x00\x00\x00\x00\x00\x03\x90" + "EOF",
+			want: []fileReplacement{
+				{Offset: 0x4, Buf: []byte("AB")},
+				{Offset: 0x10000, Buf: []byte{0x90, 0x90, 0x90}},
+			},
+		},
+		{
+			name:  "truncation size",
+			patch: "PATCH" + "\x00\x00\x04\x00\x01A" + "EOF" + "\x00\x10\x00",
+			want: []fileReplacement{
+				{Offset: 0x4, Buf: []byte("A")},
+			},
+		},
+		{
+			name:  "missing EOF marker",
+			patch: "PATCH" + "\x00\x00\x04\x00\x01A",
+			err:   "invalid IPS patch; missing EOF marker",
+		},
+		{
+			name:  "truncated record header",
+			patch: "PATCH" + "\x00\x00\x04\x00",
+			err:   "invalid IPS patch; truncated record header",
+		},
+		{
+			name:  "truncated record",
+			patch: "PATCH" + "\x00\x00\x04\x00\x04AB",
+			err:   "invalid IPS patch; truncated record at offset 0x4",
+		},
+		{
+			name:  "truncated RLE record",
+			patch: "PATCH" + "\x00\x00\x04\x00\x00\x00\x03",
+			err:   "invalid IPS patch; truncated RLE record at offset 0x4",
+		},
+	}
+	for _, g := range golden {
+		got, err := parseIPS([]byte(g.patch))
+		if !checkErr(t, g.name, err, g.err) {
+			continue
+		}
+		if !reflect.DeepEqual(got, g.want) {
+			t.Errorf("%s: binary replacements mismatch; expected %v, got %v", g.name, g.want, got)
+		}
+	}
+}
+
+// bpsNumber returns the variable-length encoding of the given number of a BPS
+// patch.
+func bpsNumber(n uint64) []byte {
+	var buf []byte
+	for {
+		x := byte(n & 0x7F)
+		n >>= 7
+		if n == 0 {
+			return append(buf, 0x80|x)
+		}
+		buf = append(buf, x)
+		n--
+	}
+}
+
+// bpsPatch returns a BPS patch of the given source and target sizes, actions
+// and target checksum.
+func bpsPatch(source []byte, targetSize int, actions []byte, targetCRC uint32) []byte {
+	buf := []byte("BPS1")
+	buf = append(buf, bpsNumber(uint64(len(source)))...)
+	buf = append(buf, bpsNumber(uint64(targetSize))...)
+	buf = append(buf, bpsNumber(0)...) // metadata size
+	buf = append(buf, actions...)
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(source))
+	buf = binary.LittleEndian.AppendUint32(buf, targetCRC)
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+func TestParseBPS(t *testing.T) {
+	source := []byte("hello world")
+	// hello world -> hellO world
+	var replace []byte
+	replace = append(replace, bpsNumber((4-1)<<2|0)...) // source read 4 bytes
+	replace = append(replace, bpsNumber((1-1)<<2|1)...) // target read 1 byte
+	replace = append(replace, 'O')
+	replace = append(replace, bpsNumber((6-1)<<2|0)...) // source read 6 bytes
+	// hello world -> hello worlh
+	var copy []byte
+	copy = append(copy, bpsNumber((10-1)<<2|0)...) // source read 10 bytes
+	copy = append(copy, bpsNumber((1-1)<<2|2)...)  // source copy 1 byte
+	copy = append(copy, bpsNumber(0<<1)...)        // from source offset 0
+	validReplace := bpsPatch(source, len(source), replace, crc32.ChecksumIEEE([]byte("hellO world")))
+	corrupt := append([]byte(nil), validReplace...)
+	corrupt[len(corrupt)-13] ^= 0xFF
+	golden := []struct {
+		name   string
+		patch  []byte
+		source []byte
+		want   []fileReplacement
+		err    string
+	}{
+		{
+			name:   "target read",
+			patch:  validReplace,
+			source: source,
+			want: []fileReplacement{
+				{Offset: 4, Buf: []byte("O"), Expect: []byte("o")},
+			},
+		},
+		{
+			name:   "source copy",
+			patch:  bpsPatch(source, len(source), copy, crc32.ChecksumIEEE([]byte("hello worlh"))),
+			source: source,
+			want: []fileReplacement{
+				{Offset: 10, Buf: []byte("h"), Expect: []byte("d")},
+			},
+		},
+		{
+			name:   "truncated patch",
+			patch:  []byte("BPS1\x80\x80"),
+			source: source,
+			err:    "invalid BPS patch; truncated patch",
+		},
+		{
+			name:   "patch checksum mismatch",
+			patch:  corrupt,
+			source: source,
+			err:    "invalid BPS patch; patch checksum mismatch",
+		},
+		{
+			name:   "source checksum mismatch",
+			patch:  validReplace,
+			source: []byte("hello there"),
+			err:    "BPS patch not applicable to PE file; source checksum mismatch",
+		},
+		{
+			name:   "target checksum mismatch",
+			patch:  bpsPatch(source, len(source), replace, crc32.ChecksumIEEE(source)),
+			source: source,
+			err:    "invalid BPS patch; target checksum mismatch",
+		},
+		{
+			name:   "file size change",
+			patch:  bpsPatch(source, len(source)+1, replace, 0),
+			source: source,
+			err:    "BPS patch changes file size from 11 to 12 bytes",
+		},
+		{
+			name:   "truncated data",
+			patch:  bpsPatch(source, len(source), replace[:len(replace)-2], 0),
+			source: source,
+			err:    "invalid BPS patch; truncated",
+		},
+		{
+			name:   "action exceeds target size",
+			patch:  bpsPatch(source, len(source), bpsNumber((12-1)<<2|0), 0),
+			source: source,
+			err:    "invalid BPS patch; action exceeds target size",
+		},
+	}
+	for _, g := range golden {
+		got, err := parseBPS(g.patch, g.source)
+		if !checkErr(t, g.name, err, g.err) {
+			continue
+		}
+		if !reflect.DeepEqual(got, g.want) {
+			t.Errorf("%s: binary replacements mismatch; expected %v, got %v", g.name, g.want, got)
+		}
+	}
+}
+
+func TestParseCmp(t *testing.T) {
+	golden := []struct {
+		name string
+		cmp  string
+		want []fileReplacement
+		err  string
+	}{
+		{
+			name: "adjacent bytes",
+			cmp:  "   5 157 117\n   6  40 137\n  10 162 122\n",
+			want: []fileReplacement{
+				{Offset: 4, Buf: []byte("O_"), Expect: []byte("o ")},
+				{Offset: 9, Buf: []byte("R"), Expect: []byte("r")},
+			},
+		},
+		{
+			name: "blank lines",
+			cmp:  "\n1 0 377\n\n",
+			want: []fileReplacement{
+				{Offset: 0, Buf: []byte{0xFF}, Expect: []byte{0x00}},
+			},
+		},
+		{
+			name: "invalid number of fields",
+			cmp:  "1 0 377\n2 0\n",
+			err:  `invalid number of fields on line 2 of "cmp -l" output; expected 3, got 2`,
+		},
+		{
+			name: "invalid file offset",
+			cmp:  "0 0 377\n",
+			err:  `invalid file offset on line 1 of "cmp -l" output; expected >= 1, got 0`,
+		},
+		{
+			name: "invalid octal byte",
+			cmp:  "1 8 377\n",
+			err:  `invalid original byte on line 1 of "cmp -l" output`,
+		},
+		{
+			name: "byte out of range",
+			cmp:  "1 0 400\n",
+			err:  `invalid patched byte on line 1 of "cmp -l" output`,
+		},
+	}
+	for _, g := range golden {
+		got, err := parseCmp([]byte(g.cmp))
+		if !checkErr(t, g.name, err, g.err) {
+			continue
+		}
+		if !reflect.DeepEqual(got, g.want) {
+			t.Errorf("%s: binary replacements mismatch; expected %v, got %v", g.name, g.want, got)
+		}
+	}
+}
+
+func TestParsePatchFileHeaders(t *testing.T) {
+	p := testPE{
+		imageBase: 0x400000,
+		entry:     0x1000,
+		sects: []testSect{
+			{name: ".text", relAddr: 0x1000, virtSize: 0x10, data: bytes.Repeat([]byte{0x90}, 0x10), flags: 0x60000020},
+		},
+	}
+	file := p.parse(t)
+	orig := p.bytes()
+	dir := t.TempDir()
+	// Patched PE file with a differing time stamp of the COFF file header.
+	patched := append([]byte(nil), orig...)
+	patched[0x48] = 0x01
+	patched[0x200+4] = 0xC3
+	patchedPath := filepath.Join(dir, "patched.exe")
+	if err := ioutil.WriteFile(patchedPath, patched, 0644); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	rs, err := parsePatchFile(patchedPath, file, log.New(buf, "", 0))
+	if err != nil {
+		t.Fatalf("unable to parse patched PE file; %v", err)
+	}
+	want := Replacements{{Addr: 0x401004, Buf: []byte{0xC3}, Expect: &Expected{Buf: []byte{0x90}}}}
+	if !reflect.DeepEqual(rs, want) {
+		t.Errorf("binary replacements mismatch; expected %v, got %v", want, rs)
+	}
+	const wantLog = "skipping 1 differing bytes at file offset 0x48 of patched PE file; not within section contents\n"
+	if buf.String() != wantLog {
+		t.Errorf("log mismatch; expected %q, got %q", wantLog, buf.String())
+	}
+	// Binary replacements of IPS patches within the headers are rejected.
+	ipsPath := filepath.Join(dir, "patch.ips")
+	if err := ioutil.WriteFile(ipsPath, []byte("PATCH"+"\x00\x00\x48\x00\x01\x01"+"EOF"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = parsePatchFile(ipsPath, file, discard)
+	checkErr(t, "IPS patch of headers", err, "binary replacement at file offset 0x48 not within section contents of PE file")
+}
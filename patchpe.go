@@ -0,0 +1,59 @@
+package zelda
+
+import (
+	"io/ioutil"
+	"log"
+
+	"github.com/mewmew/pe"
+	"github.com/pkg/errors"
+)
+
+// PatchPE applies the patches of the given options to the PE file, and returns
+// the contents of the patched PE file. Only patches which modify section
+// contents directly are applied; assembly patches are rejected, and statically
+// linked libraries and hooks are ignored, as these require relinking. Patched
+// bytes and the patch plan are logged to logger, if non-nil.
+func PatchPE(pePath string, opts Options, logger *log.Logger) ([]byte, error) {
+	if len(opts.AsmPatches) > 0 {
+		return nil, errors.Errorf("unable to apply %d assembly patches to PE file; assembly patches require relinking", len(opts.AsmPatches))
+	}
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+	// Statically linked libraries and hooks are injected when relinking.
+	opts.StaticLibs = nil
+	opts.HookLibs = nil
+	file, err := pe.ParseFile(pePath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// The section contents alias the file contents of the PE file.
+	sects := ParseSections(file)
+	var fileReplaces Replacements
+	if len(opts.PatchFile) > 0 {
+		fileReplaces, err = parsePatchFile(opts.PatchFile, file, logger)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	plan := newPatchPlan(opts, fileReplaces, nil, AddrRange{})
+	if err := plan.check(sects); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	resolveErr := plan.resolve()
+	if opts.ExplainPatches {
+		if err := plan.explain(logger.Writer()); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if resolveErr != nil {
+		return nil, errors.WithStack(resolveErr)
+	}
+	for _, sect := range sects {
+		plan.apply(sect, logger)
+	}
+	if err := plan.checkApplied(sects); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return file.Content, nil
+}
@@ -0,0 +1,97 @@
+package zelda
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mewkiz/pkg/jsonutil"
+	"github.com/mewkiz/pkg/pathutil"
+	"github.com/mewmew/pe"
+	"github.com/pkg/errors"
+)
+
+// projectVersion is the version of the project file format.
+const projectVersion = 1
+
+// Project is a project file, which captures an entire relink configuration.
+type Project struct {
+	// Version of project file format.
+	Version int `json:"version"`
+	// Path to PE file.
+	Input string `json:"input"`
+	// Relink options.
+	Options
+}
+
+// ParseProject parses the given project file. Relative paths of the project
+// file are resolved relative to the directory of the project file.
+func ParseProject(projectPath string) (*Project, error) {
+	proj := &Project{
+		Options: Options{
+			Base:      DefaultBase,
+			TraceArgs: DefaultTraceArgs,
+		},
+	}
+	if err := jsonutil.ParseFile(projectPath, proj); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if proj.Version != projectVersion {
+		return nil, errors.Errorf("unsupported version of project file %q; expected %d, got %d", projectPath, projectVersion, proj.Version)
+	}
+	dir := filepath.Dir(projectPath)
+	for _, path := range []*string{&proj.Input, &proj.Output, &proj.PatchFile, &proj.ProtoFile} {
+		if len(*path) > 0 && !filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+	return proj, nil
+}
+
+// InitProject writes a skeleton project file of the given PE file.
+func InitProject(projectPath, pePath string) error {
+	if _, err := os.Stat(projectPath); err == nil {
+		return errors.Errorf("project file %q already exists", projectPath)
+	}
+	file, err := pe.ParseFile(pePath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// Paths are relative to the directory of the project file.
+	input, err := filepath.Rel(filepath.Dir(projectPath), pePath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	proj := &Project{
+		Version: projectVersion,
+		Input:   input,
+		Options: Options{
+			Output:       pathutil.TrimExt(input) + ".asm",
+			Base:         DefaultBase,
+			Entry:        Address(file.OptHdr.ImageBase) + Address(file.OptHdr.EntryRelAddr),
+			Libs:         make(map[string]string),
+			Ints:         AddrRanges{},
+			Nops:         AddrRanges{},
+			Replaces:     Replacements{},
+			AsmPatches:   AsmPatches{},
+			Exports:      []Export{},
+			StaticLibs:   []StaticLib{},
+			StdcallFuncs: []StdcallFunc{},
+			HookLibs:     []HookLib{},
+			TraceArgs:    DefaultTraceArgs,
+		},
+	}
+	for _, lib := range parseImports(file, nil) {
+		proj.Libs[lib.DLL] = lib.Filename
+	}
+	buf, err := json.MarshalIndent(proj, "", "\t")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	buf = append(buf, '\n')
+	if err := ioutil.WriteFile(projectPath, buf, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
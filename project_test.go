@@ -0,0 +1,94 @@
+package zelda
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseProject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zelda")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	projDir := filepath.Join(dir, "proj")
+	if err := os.Mkdir(projDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	absPatch := filepath.Join(dir, "patches", "foo.ips")
+	golden := []struct {
+		name    string
+		content string
+		want    Project
+		err     string
+	}{
+		{
+			name: "relative paths",
+			content: `{
+	"version": 1,
+	"input": "foo.exe",
+	"output": "out/foo.asm",
+	"patch_file": "` + filepath.ToSlash(absPatch) + `",
+	"protos": "../win32.protos",
+	"nops": ["0x401000-0x401002"]
+}`,
+			want: Project{
+				Version: 1,
+				Input:   filepath.Join(projDir, "foo.exe"),
+				Options: Options{
+					Output:    filepath.Join(projDir, "out", "foo.asm"),
+					Base:      DefaultBase,
+					PatchFile: absPatch,
+					ProtoFile: filepath.Join(dir, "win32.protos"),
+					TraceArgs: DefaultTraceArgs,
+				},
+			},
+		},
+		{
+			name: "overridden defaults",
+			content: `{
+	"version": 1,
+	"base": "0x200000",
+	"trace_args": 8
+}`,
+			want: Project{
+				Version: 1,
+				Options: Options{
+					Base:      0x200000,
+					TraceArgs: 8,
+				},
+			},
+		},
+		{
+			name:    "unsupported version",
+			content: `{"version": 2}`,
+			err:     "unsupported version of project file",
+		},
+		{
+			name:    "missing version",
+			content: `{"input": "foo.exe"}`,
+			err:     "expected 1, got 0",
+		},
+	}
+	for _, g := range golden {
+		projectPath := filepath.Join(projDir, "foo.json")
+		if err := ioutil.WriteFile(projectPath, []byte(g.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		proj, err := ParseProject(projectPath)
+		if !checkErr(t, g.name, err, g.err) {
+			continue
+		}
+		if proj.Version != g.want.Version || proj.Input != g.want.Input {
+			t.Errorf("%s: version or input mismatch; expected (%d, %q), got (%d, %q)", g.name, g.want.Version, g.want.Input, proj.Version, proj.Input)
+		}
+		if proj.Output != g.want.Output || proj.PatchFile != g.want.PatchFile || proj.ProtoFile != g.want.ProtoFile {
+			t.Errorf("%s: paths mismatch; expected (%q, %q, %q), got (%q, %q, %q)", g.name, g.want.Output, g.want.PatchFile, g.want.ProtoFile, proj.Output, proj.PatchFile, proj.ProtoFile)
+		}
+		if proj.Base != g.want.Base || proj.TraceArgs != g.want.TraceArgs {
+			t.Errorf("%s: defaults mismatch; expected (%s, %d), got (%s, %d)", g.name, g.want.Base, g.want.TraceArgs, proj.Base, proj.TraceArgs)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package zelda
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Proto is a function prototype.
+type Proto struct {
+	// Return type.
+	Ret string
+	// Function name.
+	Name string
+	// Callee cleans the stack (e.g. WINAPI).
+	Stdcall bool
+	// Function parameters.
+	Params []Param
+	// Variadic function.
+	Variadic bool
+}
+
+// Param is a function parameter.
+type Param struct {
+	// Parameter type.
+	Type string
+	// Parameter name.
+	Name string
+}
+
+// String returns the C declaration of the function prototype, without
+// calling convention (e.g. "DWORD GetLastError(void)").
+func (proto *Proto) String() string {
+	return fmt.Sprintf("%s(%s)", cDecl(proto.Ret, proto.Name), proto.ParamList())
+}
+
+// ParamList returns the comma-separated C parameter declarations of the
+// function prototype (e.g. "HANDLE hObject"), or "void" if the function takes
+// no parameters.
+func (proto *Proto) ParamList() string {
+	var params []string
+	for _, param := range proto.Params {
+		params = append(params, cDecl(param.Type, param.Name))
+	}
+	if proto.Variadic {
+		params = append(params, "...")
+	}
+	if len(params) == 0 {
+		return "void"
+	}
+	return strings.Join(params, ", ")
+}
+
+// ArgSize returns the size in bytes of the stack arguments of the function.
+// The size of variadic arguments is not included.
+func (proto *Proto) ArgSize() int {
+	size := 0
+	for _, param := range proto.Params {
+		size += typeSize(param.Type)
+	}
+	return size
+}
+
+// cDecl returns the C declaration of the given name with the given type.
+func cDecl(typ, name string) string {
+	if strings.HasSuffix(typ, "*") {
+		return typ + name
+	}
+	return typ + " " + name
+}
+
+// typeSize returns the size in bytes of a stack argument of the given type.
+func typeSize(typ string) int {
+	switch typ {
+	case "double", "long long", "unsigned long long", "__int64", "unsigned __int64", "LONGLONG", "ULONGLONG", "DWORD64", "INT64", "UINT64", "LONG64", "ULONG64", "LARGE_INTEGER", "ULARGE_INTEGER", "FILETIME":
+		return 8
+	}
+	return 4
+}
+
+// --- [ Prototype database ] --------------------------------------------------
+
+// ProtoDB is a database of function prototypes, keyed by lower-case DLL file
+// name and function name.
+type ProtoDB map[string]map[string]*Proto
+
+// Lookup returns the prototype of the given function of the given DLL
+// (case-insensitive); or nil if not present.
+func (db ProtoDB) Lookup(dll, funcName string) *Proto {
+	return db[strings.ToLower(dll)][funcName]
+}
+
+// win32Protos is the prototype database of Win32 functions shipped with zelda.
+//
+//go:embed win32.protos
+var win32Protos string
+
+// Win32Protos is the prototype database of Win32 functions shipped with zelda.
+var Win32Protos ProtoDB
+
+func init() {
+	db, err := ParseProtos(strings.NewReader(win32Protos))
+	if err != nil {
+		panic(fmt.Sprintf("%+v", err))
+	}
+	Win32Protos = db
+}
+
+// loadProtos returns the prototype database of the bundled Win32 prototypes,
+// overridden by the prototypes of the given prototype file, if specified.
+func loadProtos(protoFile string) (ProtoDB, error) {
+	if len(protoFile) == 0 {
+		return Win32Protos, nil
+	}
+	protos, err := ParseProtoFile(protoFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	db := make(ProtoDB)
+	for _, d := range []ProtoDB{Win32Protos, protos} {
+		for dll, funcs := range d {
+			if _, ok := db[dll]; !ok {
+				db[dll] = make(map[string]*Proto)
+			}
+			for funcName, proto := range funcs {
+				db[dll][funcName] = proto
+			}
+		}
+	}
+	return db, nil
+}
+
+// ParseProtoFile parses the given prototype file, in the format of ParseProtos.
+func ParseProtoFile(protoPath string) (ProtoDB, error) {
+	f, err := os.Open(protoPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+	db, err := ParseProtos(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse prototype file %q", protoPath)
+	}
+	return db, nil
+}
+
+// ParseProtos parses a prototype database from r, in a header-like text format.
+// Each line is either empty, a comment starting with '#', a header of
+// whitespace-separated DLL file names within square brackets, or a C function
+// prototype of the DLLs of the preceding header; as terminated by a semicolon.
+//
+//	# Prototypes of kernel32.
+//	[kernel32.dll]
+//	DWORD WINAPI GetLastError(void);
+//	void WINAPI Sleep(DWORD dwMilliseconds);
+//
+// Parameters are either named or unnamed, and pointer declarators are part of
+// the parameter type. Functions declared WINAPI (or __stdcall, APIENTRY or
+// CALLBACK) clean the stack; other functions are __cdecl.
+func ParseProtos(r io.Reader) (ProtoDB, error) {
+	db := make(ProtoDB)
+	var dlls []string
+	s := bufio.NewScanner(r)
+	for lineNr := 1; s.Scan(); lineNr++ {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case len(line) == 0, strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "["):
+			if !strings.HasSuffix(line, "]") {
+				return nil, errors.Errorf("line %d: invalid DLL header %q; missing ']'", lineNr, line)
+			}
+			dlls = strings.Fields(strings.ToLower(line[1 : len(line)-1]))
+			if len(dlls) == 0 {
+				return nil, errors.Errorf("line %d: empty DLL header", lineNr)
+			}
+			for _, dll := range dlls {
+				if _, ok := db[dll]; !ok {
+					db[dll] = make(map[string]*Proto)
+				}
+			}
+		default:
+			if len(dlls) == 0 {
+				return nil, errors.Errorf("line %d: function prototype %q precedes DLL header", lineNr, line)
+			}
+			proto, err := parseProto(line)
+			if err != nil {
+				return nil, errors.Wrapf(err, "line %d", lineNr)
+			}
+			for _, dll := range dlls {
+				if _, ok := db[dll][proto.Name]; ok {
+					return nil, errors.Errorf("line %d: duplicate prototype of function %q of %q", lineNr, proto.Name, dll)
+				}
+				db[dll][proto.Name] = proto
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return db, nil
+}
+
+// parseProto parses the given C function prototype.
+func parseProto(s string) (*Proto, error) {
+	if !strings.HasSuffix(s, ");") {
+		return nil, errors.Errorf("invalid function prototype %q; missing trailing ');'", s)
+	}
+	start := strings.Index(s, "(")
+	if start == -1 {
+		return nil, errors.Errorf("invalid function prototype %q; missing '('", s)
+	}
+	// Return type, calling convention and function name.
+	proto := &Proto{}
+	var ret []string
+	for _, field := range strings.Fields(strings.Replace(s[:start], "*", " * ", -1)) {
+		switch field {
+		case "WINAPI", "__stdcall", "APIENTRY", "CALLBACK":
+			proto.Stdcall = true
+		case "WINAPIV", "__cdecl", "CDECL":
+		default:
+			ret = append(ret, field)
+		}
+	}
+	typ, name := splitDecl(ret)
+	if len(typ) == 0 || !isIdent(name) {
+		return nil, errors.Errorf("invalid function prototype %q; expected return type and function name", s)
+	}
+	proto.Ret, proto.Name = typ, name
+	// Parameters.
+	params := strings.TrimSpace(s[start+1 : len(s)-len(");")])
+	if params == "void" || len(params) == 0 {
+		return proto, nil
+	}
+	for i, p := range strings.Split(params, ",") {
+		p = strings.TrimSpace(p)
+		if p == "..." {
+			proto.Variadic = true
+			continue
+		}
+		if proto.Variadic {
+			return nil, errors.Errorf("invalid function prototype %q; parameter following '...'", s)
+		}
+		fields := strings.Fields(strings.Replace(p, "*", " * ", -1))
+		param := Param{}
+		if len(fields) > 1 && isIdent(fields[len(fields)-1]) && !isTypeKeyword(fields[len(fields)-1]) {
+			param.Type, param.Name = splitDecl(fields)
+		} else {
+			// Unnamed parameter.
+			param.Type = joinType(fields)
+			param.Name = fmt.Sprintf("arg%d", i+1)
+		}
+		if len(param.Type) == 0 {
+			return nil, errors.Errorf("invalid function prototype %q; invalid parameter %q", s, p)
+		}
+		proto.Params = append(proto.Params, param)
+	}
+	return proto, nil
+}
+
+// splitDecl splits the given whitespace-separated fields of a C declaration
+// into type and name; where pointer declarators are separate fields and part of
+// the type.
+func splitDecl(fields []string) (typ, name string) {
+	if len(fields) == 0 {
+		return "", ""
+	}
+	return joinType(fields[:len(fields)-1]), fields[len(fields)-1]
+}
+
+// joinType joins the given whitespace-separated fields of a C type, attaching
+// pointer declarators (e.g. "const char *").
+func joinType(fields []string) string {
+	typ := ""
+	for _, field := range fields {
+		switch {
+		case field == "*":
+			if !strings.HasSuffix(typ, "*") {
+				typ += " "
+			}
+			typ += field
+		case len(typ) > 0:
+			typ += " " + field
+		default:
+			typ = field
+		}
+	}
+	return typ
+}
+
+// isTypeKeyword reports whether the given identifier is a C keyword of types,
+// and thus not a parameter name.
+func isTypeKeyword(s string) bool {
+	switch s {
+	case "char", "short", "int", "long", "float", "double", "signed", "unsigned", "void", "const", "volatile":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package zelda
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseProtos(t *testing.T) {
+	golden := []struct {
+		name   string
+		protos string
+		// DLL file name and function name of prototype.
+		dll, funcName string
+		want          *Proto
+		err           string
+	}{
+		{
+			name:     "WINAPI",
+			protos:   "[kernel32.dll]\nvoid WINAPI Sleep(DWORD dwMilliseconds);\n",
+			dll:      "kernel32.dll",
+			funcName: "Sleep",
+			want:     &Proto{Ret: "void", Name: "Sleep", Stdcall: true, Params: []Param{{Type: "DWORD", Name: "dwMilliseconds"}}},
+		},
+		{
+			name:     "cdecl",
+			protos:   "[msvcrt.dll]\nint __cdecl abs(int n);\n",
+			dll:      "msvcrt.dll",
+			funcName: "abs",
+			want:     &Proto{Ret: "int", Name: "abs", Params: []Param{{Type: "int", Name: "n"}}},
+		},
+		{
+			name:     "variadic",
+			protos:   "[msvcrt.dll]\nint printf(const char *format, ...);\n",
+			dll:      "msvcrt.dll",
+			funcName: "printf",
+			want:     &Proto{Ret: "int", Name: "printf", Params: []Param{{Type: "const char *", Name: "format"}}, Variadic: true},
+		},
+		{
+			name:     "pointer return type and unnamed parameters",
+			protos:   "# comment\n\n[MSVCRT.dll crtdll.dll]\nchar* strncpy(char*, const char *, unsigned int);\n",
+			dll:      "crtdll.dll",
+			funcName: "strncpy",
+			want:     &Proto{Ret: "char *", Name: "strncpy", Params: []Param{{Type: "char *", Name: "arg1"}, {Type: "const char *", Name: "arg2"}, {Type: "unsigned int", Name: "arg3"}}},
+		},
+		{
+			name:     "void parameter list",
+			protos:   "[kernel32.dll]\nDWORD WINAPI GetLastError(void);\n",
+			dll:      "kernel32.dll",
+			funcName: "GetLastError",
+			want:     &Proto{Ret: "DWORD", Name: "GetLastError", Stdcall: true},
+		},
+		{
+			name:   "missing trailing semicolon",
+			protos: "[kernel32.dll]\nvoid WINAPI Sleep(DWORD dwMilliseconds)\n",
+			err:    `line 2: invalid function prototype "void WINAPI Sleep(DWORD dwMilliseconds)"; missing trailing ');'`,
+		},
+		{
+			name:   "missing return type",
+			protos: "[kernel32.dll]\nWINAPI Sleep(DWORD dwMilliseconds);\n",
+			err:    "line 2: invalid function prototype \"WINAPI Sleep(DWORD dwMilliseconds);\"; expected return type and function name",
+		},
+		{
+			name:   "parameter following variadic arguments",
+			protos: "[msvcrt.dll]\nint printf(..., const char *format);\n",
+			err:    "line 2: invalid function prototype \"int printf(..., const char *format);\"; parameter following '...'",
+		},
+		{
+			name:   "missing DLL header",
+			protos: "void WINAPI Sleep(DWORD dwMilliseconds);\n",
+			err:    "line 1: function prototype \"void WINAPI Sleep(DWORD dwMilliseconds);\" precedes DLL header",
+		},
+		{
+			name:   "duplicate prototype",
+			protos: "[kernel32.dll]\nvoid WINAPI Sleep(DWORD dwMilliseconds);\nvoid WINAPI Sleep(DWORD ms);\n",
+			err:    `line 3: duplicate prototype of function "Sleep" of "kernel32.dll"`,
+		},
+	}
+	for _, g := range golden {
+		db, err := ParseProtos(strings.NewReader(g.protos))
+		if !checkErr(t, g.name, err, g.err) {
+			continue
+		}
+		got := db.Lookup(g.dll, g.funcName)
+		if !reflect.DeepEqual(got, g.want) {
+			t.Errorf("%s: prototype mismatch; expected %#v, got %#v", g.name, g.want, got)
+		}
+	}
+}
+
+func TestProtoArgSize(t *testing.T) {
+	golden := []struct {
+		proto string
+		want  int
+	}{
+		{proto: "DWORD WINAPI GetLastError(void);", want: 0},
+		{proto: "BOOL WINAPI ReadFile(HANDLE hFile, LPVOID lpBuffer, DWORD nNumberOfBytesToRead, LPDWORD lpNumberOfBytesRead, LPOVERLAPPED lpOverlapped);", want: 20},
+		{proto: "BOOL WINAPI SetFileTime(HANDLE hFile, const FILETIME *lpCreationTime, const FILETIME *lpLastAccessTime, const FILETIME *lpLastWriteTime);", want: 16},
+		{proto: "double pow(double x, double y);", want: 16},
+		{proto: "int printf(const char *format, ...);", want: 4},
+	}
+	for _, g := range golden {
+		proto, err := parseProto(g.proto)
+		if err != nil {
+			t.Errorf("%q: unable to parse prototype; %v", g.proto, err)
+			continue
+		}
+		if got := proto.ArgSize(); got != g.want {
+			t.Errorf("%q: stack argument size mismatch; expected %d, got %d", g.proto, g.want, got)
+		}
+	}
+}
+
+func TestLoadProtos(t *testing.T) {
+	const protos = `
+[kernel32.dll]
+# Overrides the bundled prototype.
+void __cdecl Sleep(DWORD dwMilliseconds);
+
+[foo.dll]
+int WINAPI foo(int a, int b);
+`
+	protoPath := filepath.Join(t.TempDir(), "foo.protos")
+	if err := ioutil.WriteFile(protoPath, []byte(protos), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := loadProtos(protoPath)
+	if err != nil {
+		t.Fatalf("unable to load prototypes; %v", err)
+	}
+	golden := []struct {
+		dll, funcName string
+		// Stack argument size of __stdcall function; or -1 for __cdecl function.
+		argSize int
+	}{
+		// Overridden prototype.
+		{dll: "KERNEL32.dll", funcName: "Sleep", argSize: -1},
+		// Bundled prototype of the same DLL.
+		{dll: "KERNEL32.dll", funcName: "ExitProcess", argSize: 4},
+		// Prototype of other DLL.
+		{dll: "foo.dll", funcName: "foo", argSize: 8},
+	}
+	for _, g := range golden {
+		proto := db.Lookup(g.dll, g.funcName)
+		if proto == nil {
+			t.Errorf("%s: unable to locate prototype of %q", g.funcName, g.dll)
+			continue
+		}
+		argSize := -1
+		if proto.Stdcall {
+			argSize = proto.ArgSize()
+		}
+		if argSize != g.argSize {
+			t.Errorf("%s: stack argument size mismatch; expected %d, got %d", g.funcName, g.argSize, argSize)
+		}
+	}
+	// The bundled prototypes are not modified.
+	if proto := Win32Protos.Lookup("kernel32.dll", "Sleep"); proto == nil || !proto.Stdcall {
+		t.Errorf("bundled prototype of Sleep modified; got %v", proto)
+	}
+}
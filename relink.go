@@ -0,0 +1,897 @@
+// Package zelda relinks PE files into ELF files.
+package zelda
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/mewkiz/pkg/pathutil"
+	"github.com/mewmew/pe"
+	"github.com/pkg/errors"
+)
+
+// Relinker relinks PE files into NASM listings of ELF files.
+type Relinker struct {
+	// Relink options.
+	Options Options
+	// (optional) Logger of patched bytes and the patch plan.
+	Logger *log.Logger
+}
+
+// NewRelinker returns a new relinker based on the given relink options.
+func NewRelinker(opts Options) *Relinker {
+	return &Relinker{Options: opts}
+}
+
+// Result is the result of relinking a PE file.
+type Result struct {
+	// Address of entry point.
+	Entry Address
+	// Relinked into a shared library.
+	IsSharedLib bool
+	// Sections of PE file, as patched.
+	Sects []*Section
+	// Loadable segments of sections.
+	Segments []*Segment
+	// Shared libraries; imported libraries followed by the dynamic libraries of
+	// statically linked libraries and hook libraries.
+	Libs []Library
+	// Exported symbols, including hook trampolines.
+	Exports []Export
+	// Hooked functions.
+	Hooks []Hook
+	// Patches of section contents, sorted by start address.
+	Patches []*Patch
+	// Entries of the import address tables, redirected to .plt entries.
+	IATSlots []IATSlot
+	// Statically linked libraries, replaced with dynamic libraries.
+	StaticLibs []StaticLib
+}
+
+// Relink relinks the given PE file into a NASM listing of a corresponding ELF
+// file, writing to w. If specified, the nop address ranges are nop'ed out, and
+// the statically linked libraries are replaced with dynamic libraries. Imported
+// __stdcall functions are called through thunks which clean the stack
+// arguments on behalf of the __cdecl implementation. Hooked functions are
+// intercepted by the functions of hook libraries, and remain callable through
+// trampolines. If specified, calls to imported functions are traced on
+// standard error. Patched bytes and the patch plan are logged to the logger of
+// the relinker.
+//
+// The NASM listing is written to w only if relinking succeeds.
+func (r *Relinker) Relink(w io.Writer, pePath string) (*Result, error) {
+	opts := r.Options
+	logger := r.Logger
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+	entry := opts.Entry
+	// Copy exports, as exports of hook trampolines are added below.
+	exports := append([]Export(nil), opts.Exports...)
+	// Parse PE file.
+	file, err := pe.ParseFile(pePath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Parse sections.
+	sects := ParseSections(file)
+	if opts.MapHeaders {
+		hdrs, err := parseHeaders(file, sects, opts.Base)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		sects = append([]*Section{hdrs}, sects...)
+	}
+	if err := applyPermPolicy(sects, opts.PermPolicy, opts.Writable); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Parse binary replacements of patch file.
+	var fileReplaces Replacements
+	if len(opts.PatchFile) > 0 {
+		fileReplaces, err = parsePatchFile(opts.PatchFile, file, logger)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	// Collect imported libraries and dynamic libraries.
+	libs, err := CollectLibs(file, opts)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// ___ [ Read-only segment ] ___
+	// Output header of read-only segment.
+	out := &bytes.Buffer{}
+	if err := dumpRSegPre(out, uint64(opts.Base)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Output ELF file header.
+	if entry == 0 {
+		entry = Address(file.OptHdr.ImageBase) + Address(file.OptHdr.EntryRelAddr)
+	}
+	isSharedLib := len(exports) > 0
+	if opts.Startup && isSharedLib {
+		return nil, errors.New("unable to enter shared library through startup stub")
+	}
+	if opts.SEH && !opts.Startup {
+		return nil, errors.New("unable to dispatch structured exceptions without startup stub")
+	}
+	if err := dumpFileHdr(out, entry, isSharedLib, opts.Startup); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Call the entry point of DLLs (DllMain) on load and unload of the shared
+	// library; DLLs without entry point have an entry point address of 0.
+	dllMain := isSharedLib && (opts.Entry != 0 || file.OptHdr.EntryRelAddr != 0)
+	// Relocate prologues of hooked functions, and export trampolines through
+	// which the original functions remain callable.
+	hooks, err := parseHooks(sects, opts.HookLibs)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Collect patches of section contents, check their original content and
+	// detect overlapping patches.
+	plan := newPatchPlan(opts, fileReplaces, hooks, libImpsRange(file))
+	if err := plan.check(sects); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	resolveErr := plan.resolve()
+	if opts.ExplainPatches {
+		if err := plan.explain(logger.Writer()); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	if resolveErr != nil {
+		return nil, errors.WithStack(resolveErr)
+	}
+	for _, hook := range hooks {
+		export := Export{
+			Name:  hook.OrigName(),
+			Label: hook.OrigName(),
+		}
+		exports = append(exports, export)
+	}
+	// Apply section rules. Sections may only be moved if no patch, hook, import
+	// address table, exported symbol or entry point is located within the
+	// section, as these are resolved against the original addresses of the PE
+	// file.
+	pinned := func(start, end Address) (string, bool) {
+		for _, p := range plan.Patches {
+			if p.Start < end && start < p.End {
+				return fmt.Sprintf("%s patch %s-%s (%s)", p.Kind, p.Start, p.End, p.Origin), true
+			}
+		}
+		for _, export := range exports {
+			if len(export.Label) == 0 && start <= export.Addr && export.Addr < end {
+				return fmt.Sprintf("exported symbol %q at address %s", export.Name, export.Addr), true
+			}
+		}
+		if start <= entry && entry < end {
+			return fmt.Sprintf("entry point at address %s", entry), true
+		}
+		return "", false
+	}
+	sects, err = applySectionRules(sects, opts.SectionRules, pinned, logger)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Group sections into loadable segments, merging sections which share a
+	// page in memory.
+	segs, err := loadSegments(sects, logger)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	wx := opts.PermPolicy == PermPolicyWX
+	if wx {
+		if err := checkWX(segs); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	// Make .dynamic and .got.plt read-only after relocation, when imported
+	// functions are bound at load time.
+	relro := wx && opts.BindNow
+	// Get ELF program headers for the loadable segments.
+	progHdrs := elfProgHdrs(segs, wx, relro)
+	// Output ELF program headers.
+	if err := dumpProgHdrs(out, progHdrs); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Output sections.
+	// === [ Sections ] ===
+	// Output sections header.
+	const sectPre = "; === [ Sections ] =============================================================\n\n"
+	if _, err := out.WriteString(sectPre); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// .interp
+	if err := dumpInterpSect(out); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(exports) > 0 {
+		// .hash
+		nglobals := len(exports)
+		for _, lib := range libs {
+			nglobals += len(lib.Funcs)
+		}
+		if err := dumpHashSect(out, nglobals); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	// .dynstr
+	if err := dumpDynstrSect(out, libs, exports); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// .dynsym
+	if err := dumpDynsymSect(out, libs, exports); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// .rel.plt
+	if err := dumpRelPltSect(out, libs); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Output footer of read-only segment.
+	if err := dumpRSegPost(out); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// ___ [/ Read-only segment ] ___
+
+	// ___ [ Read-write segment ] ___
+	// Output header of read-write segment.
+	if err := dumpRWSegPre(out); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// .dynamic
+	if err := dumpDynamicSect(out, libs, exports, dllMain, opts.BindNow); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// .got.plt
+	if err := dumpGotPltSect(out, libs, relro); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Thread and process environment blocks.
+	if opts.Startup {
+		if err := dumpTEBSect(out, Address(file.OptHdr.ImageBase)); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	// Output footer of read-write segment.
+	if err := dumpRWSegPost(out); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// ___ [/ Read-write segment ] ___
+
+	// ___ [ Executable segment ] ___
+	// Output header of executable segment.
+	if err := dumpXSegPre(out); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// .plt
+	if err := dumpPltSect(out, libs, opts.TraceImports, opts.TraceArgs); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Import call tracing.
+	if opts.TraceImports {
+		maxArgs := 0
+		for _, lib := range libs {
+			for _, fn := range lib.Funcs {
+				if n := fn.TraceArgs(opts.TraceArgs); n > maxArgs {
+					maxArgs = n
+				}
+			}
+		}
+		if err := dumpTraceSect(out, maxArgs); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	// Hook trampolines.
+	if len(hooks) > 0 {
+		if err := dumpHooksSect(out, hooks); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	// DllMain initialization and termination functions.
+	if dllMain {
+		if err := dumpDllMainSect(out, Address(file.OptHdr.ImageBase), entry); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	// Startup stub.
+	if opts.Startup {
+		if err := dumpStartupSect(out, entry, opts.SEH); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	// Output footer of executable segment.
+	if err := dumpXSegPost(out); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// ___ [/ Executable segment ] ___
+
+	// Output sections of PE file.
+	prevSeg := "x_seg"
+	var fs []func(w io.Writer, addr Address, buf []byte) (int, error)
+	libImpsPrinter, err := getLibImpsPrinter(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	fs = append(fs, plan.track(PatchImports, libImpsPrinter))
+	staticLibsPrinter, err := getStaticLibsPrinter(opts.StaticLibs)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	fs = append(fs, plan.track(PatchStaticFunc, staticLibsPrinter))
+	hooksPrinter, err := getHooksPrinter(hooks)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	fs = append(fs, plan.track(PatchHook, hooksPrinter))
+	asmPatchesPrinter, err := getAsmPatchesPrinter(opts.AsmPatches)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	fs = append(fs, plan.track(PatchAsm, asmPatchesPrinter))
+	for _, seg := range segs {
+		for i, sect := range seg.Sects {
+			plan.apply(sect, logger)
+			content, err := genSectContent(sect, fs...)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			if err := dumpSect(out, seg, i, prevSeg, content); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			prevSeg = nasmIdent(sect.Name)
+		}
+	}
+	// Output sections of PE file not allocated in memory.
+	for _, sect := range sects {
+		if !sect.NoAlloc {
+			continue
+		}
+		plan.apply(sect, logger)
+		content, err := genSectContent(sect, fs...)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if err := dumpNoAllocSect(out, sect, prevSeg, content); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		prevSeg = nasmIdent(sect.Name)
+	}
+	// Reject unapplied and partially applied patches.
+	if err := plan.checkApplied(sects); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// .shstrtab section.
+	if err := dumpShstrtabSect(out, prevSeg, sects); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// Output sections footer.
+	const sectPost = "; === [/ Sections ] ============================================================\n\n"
+	if _, err := out.WriteString(sectPost); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// === [/ Sections ] ===
+
+	// === [ Section headers ] ===
+	hasGlobal := len(exports) > 0 || len(libs) > 0
+	if err := dumpSectHdrs(out, sects, segs, hasGlobal); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// === [/ Section headers ] ===
+
+	out.WriteString("\n")
+	if _, err := w.Write(out.Bytes()); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	result := &Result{
+		Entry:       entry,
+		IsSharedLib: isSharedLib,
+		Sects:       sects,
+		Segments:    segs,
+		Libs:        libs,
+		Exports:     exports,
+		Hooks:       hooks,
+		Patches:     plan.Patches,
+		IATSlots:    iatSlots(file, libs),
+		StaticLibs:  opts.StaticLibs,
+	}
+	return result, nil
+}
+
+// CollectLibs returns the imported libraries of the given PE file, mapped to
+// shared libraries, followed by the dynamic libraries of statically linked
+// libraries and hook libraries. The stack argument sizes of __stdcall functions
+// are set.
+func CollectLibs(file *pe.File, opts Options) ([]Library, error) {
+	// Parse imported libraries, with the prototypes of imported functions.
+	db, err := loadProtos(opts.ProtoFile)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	libs := parseImports(file, db)
+	// Map imported libraries to shared libraries.
+	if err := mapLibs(libs, opts.Libs); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Add dynamic libraries of statically linked libraries.
+	for _, staticLib := range opts.StaticLibs {
+		lib := Library{
+			Name:     libName(staticLib.Filename),
+			Filename: staticLib.Filename,
+		}
+		present := make(map[string]bool)
+		for _, fn := range staticLib.Funcs {
+			if _, ok := present[fn.Name]; ok {
+				// skip duplicate function names
+				continue
+			}
+			present[fn.Name] = true
+			lib.Funcs = append(lib.Funcs, Func{Name: fn.Name})
+		}
+		libs = append(libs, lib)
+	}
+	// Add dynamic libraries of hook functions.
+	for _, hookLib := range opts.HookLibs {
+		lib := Library{
+			Name:     libName(hookLib.Filename),
+			Filename: hookLib.Filename,
+		}
+		present := make(map[string]bool)
+		for _, fn := range hookLib.Funcs {
+			if _, ok := present[fn.Name]; ok {
+				// skip duplicate function names
+				continue
+			}
+			present[fn.Name] = true
+			lib.Funcs = append(lib.Funcs, Func{Name: fn.Name})
+		}
+		libs = append(libs, lib)
+	}
+	// TODO: add command line option to add extra import libraries.
+
+	// Add the SEH runtime library. The SEH runtime precedes the shims of
+	// imported libraries, so its functions (e.g. RtlUnwind) take precedence over
+	// their stubs.
+	if opts.SEH {
+		libs = append([]Library{sehLib()}, libs...)
+	}
+
+	// Set stack argument sizes of __stdcall functions.
+	if err := setArgSizes(libs, opts.StdcallFuncs); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// Call the functions of the SEH runtime library through __stdcall thunks.
+	if opts.SEH {
+		setSEHArgSizes(libs)
+	}
+	return libs, nil
+}
+
+// getStaticLibsPrinter returns a pretty-printed for statically linked library.
+func getStaticLibsPrinter(staticLibs []StaticLib) (func(w io.Writer, addr Address, buf []byte) (int, error), error) {
+	f := func(w io.Writer, addr Address, buf []byte) (int, error) {
+		for _, staticLib := range staticLibs {
+			for _, fn := range staticLib.Funcs {
+				const injectSize = 5
+				if fn.Addr == addr {
+					staticFuncName := fmt.Sprintf("%s_%08x", fn.Name, uint64(addr))
+					if _, err := fmt.Fprintf(w, "  .%s:\n", staticFuncName); err != nil {
+						return 0, errors.WithStack(err)
+					}
+					if _, err := fmt.Fprintf(w, "\tjmp     plt.%s\n", fn.Name); err != nil {
+						return 0, errors.WithStack(err)
+					}
+					if _, err := fmt.Fprintf(w, "  times (%d - ($ - .%s)) int3\n", injectSize, staticFuncName); err != nil {
+						return 0, errors.WithStack(err)
+					}
+					return injectSize, nil
+				}
+			}
+		}
+		return 0, nil
+	}
+	return f, nil
+}
+
+// getHooksPrinter returns a pretty-printer for hooked functions.
+func getHooksPrinter(hooks []Hook) (func(w io.Writer, addr Address, buf []byte) (int, error), error) {
+	f := func(w io.Writer, addr Address, buf []byte) (int, error) {
+		for _, hook := range hooks {
+			if hook.Addr == addr {
+				hookName := fmt.Sprintf("hook_%s_%08x", hook.Name, uint64(addr))
+				if _, err := fmt.Fprintf(w, "  .%s:\n", hookName); err != nil {
+					return 0, errors.WithStack(err)
+				}
+				if _, err := fmt.Fprintf(w, "\tjmp     plt.%s\n", hook.Name); err != nil {
+					return 0, errors.WithStack(err)
+				}
+				if _, err := fmt.Fprintf(w, "  times (%d - ($ - .%s)) int3\n", hook.Size, hookName); err != nil {
+					return 0, errors.WithStack(err)
+				}
+				return hook.Size, nil
+			}
+		}
+		return 0, nil
+	}
+	return f, nil
+}
+
+// getAsmPatchesPrinter returns a pretty-printer for assembly patches. The
+// assembly instructions are encoded by NASM, which reports an error with the
+// address range of the patch if the encoded instructions exceed it.
+func getAsmPatchesPrinter(patches AsmPatches) (func(w io.Writer, addr Address, buf []byte) (int, error), error) {
+	f := func(w io.Writer, addr Address, buf []byte) (int, error) {
+		for _, patch := range patches {
+			if patch.Range.Start == addr {
+				size := int(patch.Range.End - patch.Range.Start)
+				if size > len(buf) {
+					// The assembly patch extends past the initialized contents of
+					// the section.
+					return 0, nil
+				}
+				patchName := fmt.Sprintf("patch_%08x", uint64(addr))
+				if _, err := fmt.Fprintf(w, "  .%s:\n", patchName); err != nil {
+					return 0, errors.WithStack(err)
+				}
+				for _, inst := range patch.Insts {
+					if _, err := fmt.Fprintf(w, "\t%s\n", inst); err != nil {
+						return 0, errors.WithStack(err)
+					}
+				}
+				if _, err := fmt.Fprintf(w, "%%if ($ - .%s) > %d\n", patchName, size); err != nil {
+					return 0, errors.WithStack(err)
+				}
+				if _, err := fmt.Fprintf(w, "  %%error \"assembly patch at %s-%s exceeds its address range of %d bytes\"\n", patch.Range.Start, patch.Range.End, size); err != nil {
+					return 0, errors.WithStack(err)
+				}
+				if _, err := io.WriteString(w, "%endif\n"); err != nil {
+					return 0, errors.WithStack(err)
+				}
+				if _, err := fmt.Fprintf(w, "  times (%d - ($ - .%s)) nop\n", size, patchName); err != nil {
+					return 0, errors.WithStack(err)
+				}
+				return size, nil
+			}
+		}
+		return 0, nil
+	}
+	return f, nil
+}
+
+// getLibImpsPrinter returns a pretty-printed for library imports.
+func getLibImpsPrinter(file *pe.File) (func(w io.Writer, addr Address, buf []byte) (int, error), error) {
+	// === [ Library imports ] ===
+	libImpsBuf := &bytes.Buffer{}
+	impLibs := sortedImpLibs(file)
+	for _, impLib := range impLibs {
+		if err := dumpLibImps(libImpsBuf, impLib); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	libImps := libImpsRange(file)
+	// === [/ Library imports ] ===
+	f := func(w io.Writer, addr Address, buf []byte) (int, error) {
+		if addr == libImps.Start {
+			if _, err := libImpsBuf.WriteTo(w); err != nil {
+				return 0, errors.WithStack(err)
+			}
+			return int(libImps.End - libImps.Start), nil
+		}
+		return 0, nil
+	}
+	return f, nil
+}
+
+// sortedImpLibs returns the imported libraries of the given PE file, sorted by
+// the address of their import address tables.
+func sortedImpLibs(file *pe.File) []Library {
+	// Ensure that we only include libraries present in the original PE file, and
+	// not any added libraries; as these will be pretty-printed to their original
+	// offset in the .idata section of the PE.
+	impLibs := parseImports(file, nil)
+	// Sort import libraries by their occurrence in the PE file.
+	libRelAddr := make(map[string]uint32)
+	for _, imp := range file.Imps {
+		baseName := libName(imp.ImpDir.Name)
+		libRelAddr[baseName] = imp.ImpDir.IATRelAddr
+	}
+	less := func(i, j int) bool {
+		// Ensure that libraries present in the original PE file are sorted first, as their offset
+		iv, ok1 := libRelAddr[impLibs[i].Name]
+		if !ok1 {
+			panic(fmt.Errorf("invalid relative import library %q, not present in original PE file", impLibs[i].Name))
+		}
+		jv, ok2 := libRelAddr[impLibs[j].Name]
+		if !ok2 {
+			panic(fmt.Errorf("invalid relative import library %q, not present in original PE file", impLibs[j].Name))
+		}
+		return iv < jv
+	}
+	sort.Slice(impLibs, less)
+	return impLibs
+}
+
+// IATSlot is an entry of the import address tables of a PE file, redirected to
+// the .plt entry of the imported function.
+type IATSlot struct {
+	// Address of import address table entry.
+	Addr Address `json:"addr"`
+	// File name of shared library of imported function.
+	Lib string `json:"lib"`
+	// Imported function.
+	Func string `json:"func"`
+}
+
+// iatSlots returns the entries of the import address tables of the given PE
+// file, as redirected to the .plt entries of the imported functions of the
+// given shared libraries.
+func iatSlots(file *pe.File, libs []Library) []IATSlot {
+	filenames := make(map[string]string)
+	for _, lib := range libs {
+		if len(lib.DLL) > 0 {
+			filenames[lib.DLL] = lib.Filename
+		}
+	}
+	var slots []IATSlot
+	addr := libImpsRange(file).Start
+	for _, impLib := range sortedImpLibs(file) {
+		for _, fn := range impLib.Funcs {
+			slot := IATSlot{
+				Addr: addr,
+				Lib:  filenames[impLib.DLL],
+				Func: fn.Name,
+			}
+			slots = append(slots, slot)
+			addr += 4
+		}
+		// Terminating NULL import entry.
+		addr += 4
+	}
+	return slots
+}
+
+// libImpsRange returns the address range of the import address tables of the
+// given PE file, which are redirected to the .plt entries of the imported
+// functions.
+func libImpsRange(file *pe.File) AddrRange {
+	// Relative address of first import entity.
+	var minIATRelAddr Address
+	for _, imp := range file.Imps {
+		iatRelAddr := Address(imp.ImpDir.IATRelAddr)
+		if minIATRelAddr == 0 || iatRelAddr < minIATRelAddr {
+			minIATRelAddr = iatRelAddr
+		}
+	}
+	libImpsAddr := Address(file.OptHdr.ImageBase) + minIATRelAddr
+	libImpsSize := 0
+	for _, impLib := range parseImports(file, nil) {
+		// 4 bytes per function and a terminating NULL import entry.
+		libImpsSize += 4 * (len(impLib.Funcs) + 1)
+	}
+	return AddrRange{Start: libImpsAddr, End: libImpsAddr + Address(libImpsSize)}
+}
+
+// ParseSections parses the sections of the given PE file into a unified format.
+func ParseSections(file *pe.File) []*Section {
+	var sects []*Section
+	for _, sectHdr := range file.SectHdrs {
+		start := sectHdr.DataOffset
+		end := start + sectHdr.DataSize
+		data := file.Content[start:end]
+		size := int64(sectHdr.VirtualSize)
+		switch {
+		case size == 0:
+			// Some linkers leave the virtual size unset, in which case the size of
+			// raw data is used (as by the Windows loader).
+			size = int64(len(data))
+		case size < int64(len(data)):
+			// Truncate file alignment padding beyond the virtual size.
+			data = data[:size]
+		}
+		addr := Address(file.OptHdr.ImageBase) + Address(sectHdr.RelAddr)
+		perm := ParsePerm(sectHdr.Flags)
+		sect := &Section{
+			Name: sectHdr.Name,
+			Data: data,
+			Size: size,
+			Addr: addr,
+			Perm: perm,
+		}
+		sects = append(sects, sect)
+	}
+	return sects
+}
+
+// parseHeaders returns the headers of the given PE file (DOS header, NT headers
+// and section headers) as a read-only section at the image base, as mapped by
+// the Windows loader. The pages of the headers must not contain the base
+// address of the read-only segment of the ELF file.
+func parseHeaders(file *pe.File, sects []*Section, base Address) (*Section, error) {
+	size := file.OptHdr.HeadersSize
+	if int64(size) > int64(len(file.Content)) {
+		return nil, errors.Errorf("invalid size of PE headers; expected <= %d, got %d", len(file.Content), size)
+	}
+	hdrs := &Section{
+		Name: ".headers",
+		Data: file.Content[:size],
+		Size: int64(size),
+		Addr: Address(file.OptHdr.ImageBase),
+		Perm: PermR,
+	}
+	end := hdrs.Addr + Address(size)
+	if hdrs.Addr&^(pageSize-1) <= base && base < (end+pageSize-1)&^(pageSize-1) {
+		return nil, errors.Errorf("PE headers at %s-%s collide with base address %s of read-only segment; use -base", hdrs.Addr, end, base)
+	}
+	for _, sect := range sects {
+		if sect.Addr < end && hdrs.Addr < sect.Addr+Address(len(sect.Data)) {
+			return nil, errors.Errorf("PE headers at %s-%s overlap section %q at address %s", hdrs.Addr, end, sect.Name, sect.Addr)
+		}
+	}
+	return hdrs, nil
+}
+
+// elfProgHdrs returns the ELF program headers corresponding to the given
+// loadable segments of sections. The interpreter and dynamic program headers
+// are always included. If wx is set, the stack is non-executable; and if relro
+// is set, .dynamic and .got.plt are made read-only after relocation.
+func elfProgHdrs(segs []*Segment, wx, relro bool) []ProgHeader {
+	var progHdrs []ProgHeader
+	// Add interpreter program header.
+	interpProgHdr := ProgHeader{
+		Title: "Interpreter program header",
+		Type:  elf.PT_INTERP.String(),
+		Name:  "interp",
+		Flags: elf.PF_R.String(),
+		Align: fmt.Sprintf("0x%X", 1),
+	}
+	progHdrs = append(progHdrs, interpProgHdr)
+	// Add dynamic program header.
+	dynamicProgHdr := ProgHeader{
+		Title: "Dynamic array program header",
+		Type:  elf.PT_DYNAMIC.String(),
+		Name:  "dynamic",
+		Flags: elf.PF_R.String(),
+		Align: "dynamic_align",
+	}
+	progHdrs = append(progHdrs, dynamicProgHdr)
+	// Add read-only segment program header.
+	rSegProgHdr := ProgHeader{
+		Title: "Read-only segment program header",
+		Type:  elf.PT_LOAD.String(),
+		Name:  "r_seg",
+		Flags: elf.PF_R.String(),
+		Align: "PAGE",
+	}
+	progHdrs = append(progHdrs, rSegProgHdr)
+	// Add read-write segment program header.
+	rwSegProgHdr := ProgHeader{
+		Title: "Read-write segment program header",
+		Type:  elf.PT_LOAD.String(),
+		Name:  "rw_seg",
+		Flags: ProgFlagString(elf.PF_R | elf.PF_W),
+		Align: "PAGE",
+	}
+	progHdrs = append(progHdrs, rwSegProgHdr)
+	// Add executable segment program header.
+	xSegProgHdr := ProgHeader{
+		Title: "Executable segment program header",
+		Type:  elf.PT_LOAD.String(),
+		Name:  "x_seg",
+		Flags: ProgFlagString(elf.PF_R | elf.PF_X),
+		Align: "PAGE",
+	}
+	progHdrs = append(progHdrs, xSegProgHdr)
+	// Add section program headers.
+	for _, seg := range segs {
+		title := fmt.Sprintf("%s segment program header", seg.Name())
+		name := nasmIdent(seg.Sects[0].Name)
+		last := seg.Sects[len(seg.Sects)-1]
+		lastName := nasmIdent(last.Name)
+		flags := elfProgFlag(seg.Perm)
+		progHdr := ProgHeader{
+			Title: title,
+			Type:  elf.PT_LOAD.String(),
+			Name:  name,
+			Flags: ProgFlagString(flags),
+			Align: "PAGE",
+		}
+		switch {
+		case len(seg.Sects) == 1 && last.Size > int64(len(last.Data)):
+			// Uninitialized data is zero-filled by the loader.
+			progHdr.FileSize = name + ".filesz"
+			progHdr.MemSize = name + ".memsz"
+		case len(seg.Sects) > 1 && last.Size > int64(len(last.Data)):
+			progHdr.FileSize = fmt.Sprintf("%s + %s.filesz - %s", lastName, lastName, name)
+			progHdr.MemSize = fmt.Sprintf("%s + %s.memsz - %s", lastName, lastName, name)
+		case len(seg.Sects) > 1:
+			size := fmt.Sprintf("%s + %s.size - %s", lastName, lastName, name)
+			progHdr.FileSize = size
+			progHdr.MemSize = size
+		}
+		progHdrs = append(progHdrs, progHdr)
+	}
+	// Add stack program header.
+	if wx {
+		stackProgHdr := ProgHeader{
+			Title:    "Stack program header",
+			Type:     elf.PT_GNU_STACK.String(),
+			Name:     "gnu_stack",
+			Flags:    ProgFlagString(elf.PF_R | elf.PF_W),
+			Align:    "0x10",
+			Offset:   "0",
+			Addr:     "0",
+			FileSize: "0",
+			MemSize:  "0",
+		}
+		progHdrs = append(progHdrs, stackProgHdr)
+	}
+	// Add read-only after relocation program header.
+	if relro {
+		relroProgHdr := ProgHeader{
+			Title:    "Read-only after relocation program header",
+			Type:     elf.PT_GNU_RELRO.String(),
+			Name:     "relro",
+			Flags:    elf.PF_R.String(),
+			Align:    "0x1",
+			Offset:   "rw_seg_off",
+			Addr:     "rw_seg",
+			FileSize: "relro.size",
+			MemSize:  "relro.size",
+		}
+		progHdrs = append(progHdrs, relroProgHdr)
+	}
+	return progHdrs
+}
+
+// parseImports parses the imported libraries of the given PE file into a
+// unified format. The prototypes of imported functions are looked up in db.
+func parseImports(file *pe.File, db ProtoDB) []Library {
+	var libs []Library
+	for _, imp := range file.Imps {
+		baseName := libName(imp.ImpDir.Name)
+		filename := baseName + ".so"
+		lib := Library{
+			Name:     baseName,
+			Filename: filename,
+			DLL:      imp.ImpDir.Name,
+		}
+		for _, iat := range imp.IATs {
+			var funcName string
+			if iat.IsOrdinal {
+				funcName = fmt.Sprintf("%s_ordinal_%d", baseName, iat.Ordinal)
+			} else {
+				funcName = iat.NameEntry.Name
+			}
+			fn := Func{
+				Name:  funcName,
+				Proto: db.Lookup(imp.ImpDir.Name, funcName),
+			}
+			lib.Funcs = append(lib.Funcs, fn)
+		}
+		libs = append(libs, lib)
+	}
+	return libs
+}
+
+// libName returns the basename without extension of the given library file
+// name.
+func libName(filename string) string {
+	filename = strings.ToLower(filename)
+	// libc.so.6 -> libc
+	for {
+		// Trim multiple extensions, as used by symlinks.
+		s := pathutil.TrimExt(filename)
+		if s == filename {
+			return s
+		}
+		filename = s
+	}
+}
@@ -0,0 +1,413 @@
+package zelda
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// checkListing reports the given snippets not present in the NASM listing.
+func checkListing(t *testing.T, name, asm string, snippets []string) {
+	t.Helper()
+	for _, snippet := range snippets {
+		if !strings.Contains(asm, snippet) {
+			t.Errorf("%s: unable to locate %q in NASM listing", name, snippet)
+		}
+	}
+}
+
+func TestRelinkTraceImports(t *testing.T) {
+	p := testPE{
+		imageBase: 0x400000,
+		entry:     0x1000,
+		sects: []testSect{
+			{name: ".text", relAddr: 0x1000, virtSize: 0x20, data: make([]byte, 0x20), flags: 0x60000020},
+		},
+		imps: []testImport{
+			{dll: "KERNEL32.dll", funcs: []string{"Sleep", "CreateFileA"}},
+			{dll: "msvcrt.dll", funcs: []string{"printf"}},
+			{dll: "foo.dll", funcs: []string{"foo"}},
+		},
+	}
+	asm, _ := p.relink(t, Options{TraceImports: true, TraceArgs: 2})
+	snippets := []string{
+		// __stdcall thunk of known prototype; 1 stack argument.
+		"  .Sleep:\n" +
+			"\tpush    dword dynstr.Sleep\n" +
+			"\tpush    dword 1\n" +
+			"\tcall    trace\n" +
+			"\t; __stdcall thunk;",
+		// Variadic function; at least -trace_args stack arguments.
+		"  .printf:\n" +
+			"\tpush    dword dynstr.printf\n" +
+			"\tpush    dword 2\n" +
+			"\tcall    trace\n" +
+			"\tjmp     [got_plt.printf]\n",
+		// Function of unknown prototype; -trace_args stack arguments.
+		"  .foo:\n" +
+			"\tpush    dword dynstr.foo\n" +
+			"\tpush    dword 2\n" +
+			"\tcall    trace\n" +
+			"\tjmp     [got_plt.foo]\n",
+		// Maximum number of stack arguments of traced functions (CreateFileA).
+		"TRACE_MAX_NARGS equ 7\n",
+		// Stack frame offsets of trace; above pushad (32 bytes), pushfd and the
+		// return address into the .plt entry are the number of stack arguments
+		// and the function name pushed by the .plt entry, followed by the return
+		// address and stack arguments of the imported function call.
+		"trace:\n\tpushfd\n\tpushad\n\tmov     ebp, esp\n",
+		".nargs equ 32 + 4 + 4\n" +
+			".name  equ .nargs + 4\n" +
+			".ret   equ .name + 4\n" +
+			".args equ .ret + 4\n",
+		"\tpopad\n\tpopfd\n\tret     8\n",
+	}
+	checkListing(t, "trace imports", asm, snippets)
+	// Import calls are not traced by default.
+	asm, _ = p.relink(t, Options{})
+	if strings.Contains(asm, "call    trace") || strings.Contains(asm, "TRACE_MAX_NARGS") {
+		t.Errorf("untraced: unexpected import call tracing in NASM listing")
+	}
+}
+
+func TestRelinkStartup(t *testing.T) {
+	p := testPE{
+		imageBase: 0x400000,
+		entry:     0x1010,
+		sects: []testSect{
+			{name: ".text", relAddr: 0x1000, virtSize: 0x20, data: make([]byte, 0x20), flags: 0x60000020},
+		},
+		imps: []testImport{
+			{dll: "KERNEL32.dll", funcs: []string{"ExitProcess"}},
+		},
+	}
+	asm, _ := p.relink(t, Options{Startup: true})
+	snippets := []string{
+		// The ELF file is entered through startup.
+		"_text.start equ startup\n",
+		"PE_ENTRY equ 0x401010\n",
+		"IMAGE_BASE equ 0x400000\n",
+		// TEB and PEB.
+		"\tdd      0xFFFFFFFF ; 0x00 NT_TIB.ExceptionList: End of SEH chain.\n",
+		"\tdd      teb        ; 0x18 NT_TIB.Self: Linear address of TEB.\n",
+		"\tdd      peb        ; 0x30 ProcessEnvironmentBlock\n",
+		"\tdd      IMAGE_BASE ; 0x08 ImageBaseAddress\n",
+		// Segment descriptor of set_thread_area; a 32-bit segment of 4 GB
+		// (0xFFFFF pages) at the TEB.
+		"teb_desc:\n" +
+			"\n" +
+			"  .entry_number:\n" +
+			"\tdd      -1         ; entry_number: Allocated by set_thread_area.\n" +
+			"\tdd      teb        ; base_addr: Linear address of TEB.\n" +
+			"\tdd      0xFFFFF    ; limit: Segment limit (in pages).\n" +
+			"\tdd      0x51       ; flags: seg_32bit | limit_in_pages | useable\n",
+		// Installation of TEB through FS.
+		"\tmov     eax, SYS_SET_THREAD_AREA\n" +
+			"\tmov     ebx, teb_desc\n" +
+			"\tint     0x80\n" +
+			"\ttest    eax, eax\n" +
+			"\tjnz     .fail\n" +
+			"\tmov     eax, [teb_desc.entry_number]\n" +
+			"\tshl     eax, 3\n" +
+			"\tor      eax, 3 ; GDT entry with requested privilege level 3.\n" +
+			"\tmov     fs, ax\n",
+		// Windows-like stack; PEB as argument and return address exiting the
+		// process.
+		"\tpush    dword peb\n" +
+			"\tpush    dword .exit\n" +
+			"\tmov     eax, PE_ENTRY\n" +
+			"\tmov     ebx, peb\n" +
+			"\tjmp     PE_ENTRY\n",
+	}
+	checkListing(t, "startup", asm, snippets)
+	if strings.Contains(asm, "zelda_seh_init") {
+		t.Errorf("startup: unexpected SEH runtime library in NASM listing")
+	}
+	// Signal handlers of the SEH runtime library are registered by startup.
+	asm, _ = p.relink(t, Options{Startup: true, SEH: true})
+	checkListing(t, "startup with SEH", asm, []string{
+		"\tand     esp, ~0xF\n" +
+			"\t; Dispatch signals of faulting instructions to the SEH chain at fs:[0].\n" +
+			"\tcall    plt.zelda_seh_init\n" +
+			"\tpush    dword peb\n",
+	})
+	// Entry point of the PE file without startup.
+	asm, _ = p.relink(t, Options{})
+	checkListing(t, "no startup", asm, []string{"_text.start equ 0x401010\n"})
+	if strings.Contains(asm, "teb_desc") {
+		t.Errorf("no startup: unexpected TEB in NASM listing")
+	}
+}
+
+func TestRelinkSEHThunks(t *testing.T) {
+	p := testPE{
+		imageBase: 0x400000,
+		entry:     0x1010,
+		sects: []testSect{
+			{name: ".text", relAddr: 0x1000, virtSize: 0x20, data: make([]byte, 0x20), flags: 0x60000020},
+		},
+		imps: []testImport{
+			{dll: "KERNEL32.dll", funcs: []string{"RaiseException"}},
+			{dll: "ntdll.dll", funcs: []string{"RtlUnwind"}},
+		},
+	}
+	// RaiseException and RtlUnwind of the SEH runtime library are called
+	// through __stdcall thunks, regardless of -stdcall.
+	stdcallFuncs := []StdcallFunc{
+		{Name: "RaiseException", ArgSize: 0},
+		{Name: "RtlUnwind", ArgSize: 0},
+	}
+	asm, res := p.relink(t, Options{Startup: true, SEH: true, StdcallFuncs: stdcallFuncs})
+	checkListing(t, "SEH thunks", asm, []string{
+		"  .RaiseException:\n" +
+			"\t; __stdcall thunk; call the __cdecl implementation and clean up 16 bytes\n",
+		"\tcall    [got_plt.RaiseException]\n" +
+			"\tleave\n" +
+			"\tret     16\n",
+		"  .RtlUnwind:\n" +
+			"\t; __stdcall thunk; call the __cdecl implementation and clean up 16 bytes\n",
+		"\tcall    [got_plt.RtlUnwind]\n" +
+			"\tleave\n" +
+			"\tret     16\n",
+	})
+	for _, lib := range res.Libs {
+		for _, fn := range lib.Funcs {
+			switch fn.Name {
+			case "RaiseException", "RtlUnwind":
+				if fn.ArgSize != 16 {
+					t.Errorf("SEH thunks: stack argument size of %q mismatch; expected 16, got %d", fn.Name, fn.ArgSize)
+				}
+			}
+		}
+	}
+	// Without the SEH runtime library, -stdcall takes effect.
+	asm, _ = p.relink(t, Options{Startup: true, StdcallFuncs: stdcallFuncs})
+	checkListing(t, "no SEH thunks", asm, []string{
+		"  .RaiseException:\n" +
+			"\tjmp     [got_plt.RaiseException]\n",
+		"  .RtlUnwind:\n" +
+			"\tjmp     [got_plt.RtlUnwind]\n",
+	})
+}
+
+func TestRelinkStartupInvalid(t *testing.T) {
+	p := testPE{
+		imageBase: 0x400000,
+		entry:     0x1000,
+		sects: []testSect{
+			{name: ".text", relAddr: 0x1000, virtSize: 0x20, data: make([]byte, 0x20), flags: 0x60000020},
+		},
+	}
+	pePath := p.write(t)
+	golden := []struct {
+		name string
+		opts Options
+		err  string
+	}{
+		{
+			name: "shared library",
+			opts: Options{Startup: true, Exports: []Export{{Name: "foo", Addr: 0x401000}}},
+			err:  "unable to enter shared library through startup stub",
+		},
+		{
+			name: "SEH without startup",
+			opts: Options{SEH: true},
+			err:  "unable to dispatch structured exceptions without startup stub",
+		},
+	}
+	for _, g := range golden {
+		g.opts.Base = DefaultBase
+		_, err := NewRelinker(g.opts).Relink(ioutil.Discard, pePath)
+		checkErr(t, g.name, err, g.err)
+	}
+}
+
+func TestRelinkDllMain(t *testing.T) {
+	p := testPE{
+		imageBase: 0x400000,
+		entry:     0x1010,
+		dll:       true,
+		sects: []testSect{
+			{name: ".text", relAddr: 0x1000, virtSize: 0x20, data: make([]byte, 0x20), flags: 0x60000020},
+		},
+		imps: []testImport{
+			{dll: "KERNEL32.dll", funcs: []string{"Sleep"}},
+		},
+	}
+	exports := []Export{{Name: "foo", Addr: 0x401000}}
+	asm, _ := p.relink(t, Options{Exports: exports})
+	snippets := []string{
+		"\tdw      ET_DYN                    ; type: File type.\n",
+		"DLL_IMAGE_BASE equ 0x400000\n",
+		"DLL_ENTRY      equ 0x401010\n",
+		// DllMain is called by the dynamic linker through DT_INIT and DT_FINI.
+		"  .init:\n" +
+			"\tdd      DT_INIT  ; tag: Entry type.\n" +
+			"\tdd      dll_init ; val: Integer/Address value.\n" +
+			"\n" +
+			"  .fini:\n" +
+			"\tdd      DT_FINI  ; tag: Entry type.\n" +
+			"\tdd      dll_fini ; val: Integer/Address value.\n",
+		"dll_init:\n" +
+			"\tpush    dword DLL_PROCESS_ATTACH\n" +
+			"\tcall    dllmain\n" +
+			"\tret\n",
+		"dll_fini:\n" +
+			"\tpush    dword DLL_PROCESS_DETACH\n" +
+			"\tcall    dllmain\n" +
+			"\tret\n",
+		// DllMain(hinstDLL, fdwReason, lpvReserved) is __stdcall; the stack is
+		// restored regardless.
+		"\tpush    dword 0              ; lpvReserved\n" +
+			"\tpush    dword [ebp + 8]      ; fdwReason\n" +
+			"\tpush    dword DLL_IMAGE_BASE ; hinstDLL\n" +
+			"\tcall    DLL_ENTRY\n" +
+			"\t; Restore the stack, regardless of whether DllMain cleaned its arguments.\n" +
+			"\tlea     esp, [ebp - 12]\n",
+	}
+	checkListing(t, "DllMain", asm, snippets)
+	// Entry point specified by -entry.
+	asm, _ = p.relink(t, Options{Exports: exports, Entry: 0x401004})
+	checkListing(t, "DllMain of -entry", asm, []string{"DLL_ENTRY      equ 0x401004\n"})
+	// DLLs without entry point have an entry point address of 0.
+	p.entry = 0
+	asm, _ = p.relink(t, Options{Exports: exports})
+	if strings.Contains(asm, "  .init:\n") || strings.Contains(asm, "dll_init") {
+		t.Errorf("no DllMain: unexpected DT_INIT entry or dll_init in NASM listing")
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	text := func(relAddr uint32) testSect {
+		return testSect{name: ".text", relAddr: relAddr, virtSize: 0x20, data: make([]byte, 0x20), flags: 0x60000020}
+	}
+	golden := []struct {
+		name string
+		p    testPE
+		base Address
+		// Size of headers.
+		size int64
+		// Names of loadable segments.
+		segs []string
+		err  string
+	}{
+		{
+			name: "not page-aligned",
+			p:    testPE{imageBase: 0x400000, hdrsSize: 0x200, sects: []testSect{text(0x1000)}},
+			base: DefaultBase,
+			size: 0x200,
+			segs: []string{".headers", ".text"},
+		},
+		{
+			name: "first section sharing page",
+			p:    testPE{imageBase: 0x400000, hdrsSize: 0x200, sects: []testSect{text(0x200)}},
+			base: DefaultBase,
+			size: 0x200,
+			segs: []string{".headers+.text"},
+		},
+		{
+			name: "overlap with first section",
+			p:    testPE{imageBase: 0x400000, hdrsSize: 0x400, sects: []testSect{text(0x200)}},
+			base: DefaultBase,
+			err:  `PE headers at 0x400000-0x400400 overlap section ".text" at address 0x400200`,
+		},
+		{
+			name: "base address at image base",
+			p:    testPE{imageBase: 0x400000, hdrsSize: 0x200, sects: []testSect{text(0x1000)}},
+			base: 0x400000,
+			err:  "PE headers at 0x400000-0x400200 collide with base address 0x400000 of read-only segment; use -base",
+		},
+		{
+			name: "base address within page of headers",
+			p:    testPE{imageBase: 0x400000, hdrsSize: 0x200, sects: []testSect{text(0x1000)}},
+			base: 0x400800,
+			err:  "PE headers at 0x400000-0x400200 collide with base address 0x400800 of read-only segment; use -base",
+		},
+		{
+			name: "base address following headers",
+			p:    testPE{imageBase: 0x400000, hdrsSize: 0x200, sects: []testSect{text(0x2000)}},
+			base: 0x401000,
+			size: 0x200,
+			segs: []string{".headers", ".text"},
+		},
+	}
+	for _, g := range golden {
+		file := g.p.parse(t)
+		sects := ParseSections(file)
+		hdrs, err := parseHeaders(file, sects, g.base)
+		if !checkErr(t, g.name, err, g.err) {
+			continue
+		}
+		if hdrs.Addr != 0x400000 || hdrs.Size != g.size || int64(len(hdrs.Data)) != g.size || hdrs.Perm != PermR {
+			t.Errorf("%s: headers mismatch; expected r-- at 0x400000 of %d bytes, got %s at %s of %d bytes (%d initialized)", g.name, g.size, hdrs.Perm, hdrs.Addr, hdrs.Size, len(hdrs.Data))
+		}
+		segs, err := loadSegments(append([]*Section{hdrs}, sects...), discard)
+		if err != nil {
+			t.Errorf("%s: unable to load segments; %v", g.name, err)
+			continue
+		}
+		var names []string
+		for _, seg := range segs {
+			names = append(names, seg.Name())
+		}
+		if !reflect.DeepEqual(names, g.segs) {
+			t.Errorf("%s: segments mismatch; expected %q, got %q", g.name, g.segs, names)
+		}
+	}
+}
+
+func TestParseSections(t *testing.T) {
+	fill := func(n int, b byte) []byte {
+		return bytes.Repeat([]byte{b}, n)
+	}
+	p := testPE{
+		imageBase: 0x400000,
+		sects: []testSect{
+			// Raw data padded to the file alignment beyond the virtual size.
+			{name: ".text", relAddr: 0x1000, virtSize: 0x30, data: fill(0x30, 0xCC), flags: 0x60000020},
+			// Virtual size unset; the size of raw data is used.
+			{name: ".rdata", relAddr: 0x2000, virtSize: 0, data: fill(0x30, 0x11), flags: 0x40000040},
+			// Initialized data followed by uninitialized data.
+			{name: ".data", relAddr: 0x3000, virtSize: 0x800, data: fill(0x10, 0x22), flags: 0xC0000040},
+			// Purely uninitialized data.
+			{name: ".bss", relAddr: 0x4000, virtSize: 0x100, flags: 0xC0000080},
+		},
+	}
+	golden := []struct {
+		name string
+		addr Address
+		size int64
+		data []byte
+		perm Perm
+	}{
+		{name: ".text", addr: 0x401000, size: 0x30, data: fill(0x30, 0xCC), perm: PermR | PermX},
+		{name: ".rdata", addr: 0x402000, size: 0x200, data: append(fill(0x30, 0x11), make([]byte, 0x1D0)...), perm: PermR},
+		{name: ".data", addr: 0x403000, size: 0x800, data: append(fill(0x10, 0x22), make([]byte, 0x1F0)...), perm: PermR | PermW},
+		{name: ".bss", addr: 0x404000, size: 0x100, data: []byte{}, perm: PermR | PermW},
+	}
+	sects := ParseSections(p.parse(t))
+	if len(sects) != len(golden) {
+		t.Fatalf("number of sections mismatch; expected %d, got %d", len(golden), len(sects))
+	}
+	for i, g := range golden {
+		sect := sects[i]
+		if sect.Name != g.name {
+			t.Errorf("section %d: name mismatch; expected %q, got %q", i, g.name, sect.Name)
+			continue
+		}
+		if sect.Addr != g.addr {
+			t.Errorf("%s: address mismatch; expected %s, got %s", g.name, g.addr, sect.Addr)
+		}
+		if sect.Size != g.size {
+			t.Errorf("%s: size mismatch; expected 0x%X, got 0x%X", g.name, g.size, sect.Size)
+		}
+		if !bytes.Equal(sect.Data, g.data) {
+			t.Errorf("%s: contents mismatch; expected %d bytes, got %d bytes", g.name, len(g.data), len(sect.Data))
+		}
+		if sect.Perm != g.perm {
+			t.Errorf("%s: access permissions mismatch; expected %s, got %s", g.name, g.perm, sect.Perm)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package zelda
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/mewmew/pe/enum"
+	"github.com/pkg/errors"
+)
+
+// A Section represents a continuous section of memory.
+type Section struct {
+	// Section name.
+	Name string
+	// Initialized contents of section.
+	Data []byte
+	// Size of section contents in number of bytes; at least len(Data). If Size >
+	// len(Data) then the missing bytes are uninitialized, and zero-filled by the
+	// loader.
+	Size int64
+	// Virtual address of section.
+	Addr Address
+	// Access permissions of section.
+	Perm Perm
+	// Section is only stored in the file, and not allocated in memory (e.g.
+	// debug sections).
+	NoAlloc bool
+}
+
+// fill fills the address range with the given byte if present in the section,
+// and returns the number of bytes filled. Only the initialized contents of the
+// section are filled. Each filled byte is logged to logger.
+func (sect *Section) fill(a AddrRange, b byte, logger *log.Logger) int {
+	start := sect.Addr
+	end := start + Address(len(sect.Data))
+	if a.Start >= end {
+		return 0
+	}
+	if a.End <= start {
+		return 0
+	}
+	n := 0
+	for addr := a.Start; addr < a.End; addr++ {
+		if start <= addr && addr < end {
+			pos := addr - sect.Addr
+			logger.Printf("fill address %s with 0x%02X", addr, b)
+			sect.Data[pos] = b
+			n++
+		}
+	}
+	return n
+}
+
+// replace replaces the contents at the given address with the specified bytes
+// buffer, and returns the number of bytes replaced. Only the initialized
+// contents of the section are replaced. Each replaced byte is logged to logger.
+func (sect *Section) replace(addr Address, buf []byte, logger *log.Logger) int {
+	sectStart := sect.Addr
+	sectEnd := sectStart + Address(len(sect.Data))
+	bufStart := addr
+	bufEnd := addr + Address(len(buf))
+	if bufStart >= sectEnd {
+		return 0
+	}
+	if bufEnd <= sectStart {
+		return 0
+	}
+	n := 0
+	for i, b := range buf {
+		a := bufStart + Address(i)
+		if sectStart <= a && a < sectEnd {
+			logger.Printf("replace byte at address %s with 0x%02X", a, b)
+			sect.Data[a-sectStart] = b
+			n++
+		}
+	}
+	return n
+}
+
+// uninit reports whether the address range overlaps with the uninitialized
+// contents of the section.
+func (sect *Section) uninit(start, end Address) bool {
+	uninitStart := sect.Addr + Address(len(sect.Data))
+	uninitEnd := sect.Addr + Address(sect.Size)
+	return start < uninitEnd && uninitStart < end
+}
+
+// --- [ Loadable segments ] ---------------------------------------------------
+
+// pageSize is the page size of loadable segments.
+const pageSize = 0x1000
+
+// A Segment is a loadable segment of one or more adjacent sections. Sections
+// sharing a page in memory (e.g. of PE files with a section alignment below the
+// page size) are merged into one segment, as the pages of a loadable segment
+// are mapped with the same access permissions.
+type Segment struct {
+	// Sections of segment, sorted by address.
+	Sects []*Section
+	// Access permissions of segment; the union of the access permissions of its
+	// sections.
+	Perm Perm
+}
+
+// Name returns the name of the segment (e.g. ".text+.rdata").
+func (seg *Segment) Name() string {
+	var names []string
+	for _, sect := range seg.Sects {
+		names = append(names, sect.Name)
+	}
+	return strings.Join(names, "+")
+}
+
+// start returns the virtual address of the NASM section of the i:th section of
+// the segment; the section address rounded down to page alignment for the
+// first section of the segment, as the file offset and virtual address of
+// loadable segments are congruent modulo the page size.
+func (seg *Segment) start(i int) Address {
+	addr := seg.Sects[i].Addr
+	if i == 0 {
+		return addr &^ (pageSize - 1)
+	}
+	return addr
+}
+
+// next returns the address of the section following the i:th section of the
+// segment; or 0 if the i:th section is the last section of the segment.
+func (seg *Segment) next(i int) Address {
+	if i+1 < len(seg.Sects) {
+		return seg.Sects[i+1].Addr
+	}
+	return 0
+}
+
+// loadSegments groups the given sections into loadable segments, merging
+// sections which share a page in memory. Sections not allocated in memory are
+// skipped. Access permissions widened by merging are reported to logger.
+func loadSegments(sects []*Section, logger *log.Logger) ([]*Segment, error) {
+	var segs []*Segment
+	var prev *Section
+	for _, sect := range sects {
+		if sect.NoAlloc {
+			continue
+		}
+		if prev != nil {
+			prevEnd := prev.Addr + Address(prev.Size)
+			if sect.Addr < prevEnd {
+				return nil, errors.Errorf("section %q at address %s overlaps section %q at %s-%s", sect.Name, sect.Addr, prev.Name, prev.Addr, prevEnd)
+			}
+			if sect.Addr&^(pageSize-1) < (prevEnd+pageSize-1)&^(pageSize-1) {
+				// Section shares a page with the preceding section.
+				seg := segs[len(segs)-1]
+				seg.Sects = append(seg.Sects, sect)
+				seg.Perm |= sect.Perm
+				prev = sect
+				continue
+			}
+		}
+		segs = append(segs, &Segment{Sects: []*Section{sect}, Perm: sect.Perm})
+		prev = sect
+	}
+	for _, seg := range segs {
+		if len(seg.Sects) == 1 {
+			continue
+		}
+		logger.Printf("sections sharing pages merged into loadable segment %q at address %s with access permissions %s", seg.Name(), seg.Sects[0].Addr, seg.Perm)
+		for _, sect := range seg.Sects {
+			if sect.Perm != seg.Perm {
+				logger.Printf("access permissions of section %q widened from %s to %s", sect.Name, sect.Perm, seg.Perm)
+			}
+		}
+	}
+	return segs, nil
+}
+
+// --- [ Access permission policies ] ------------------------------------------
+
+// PermPolicy specifies the access permissions of the loadable segments of PE
+// sections.
+type PermPolicy uint8
+
+// Access permission policies.
+const (
+	// PermPolicyRWXText keeps the access permissions of PE sections, except for
+	// the .text section which is made writable to support binary
+	// instrumentation at runtime (default).
+	PermPolicyRWXText PermPolicy = iota
+	// PermPolicyPE keeps the access permissions of PE sections.
+	PermPolicyPE
+	// PermPolicyWX keeps the access permissions of PE sections and enforces W^X;
+	// no loadable segment is both writable and executable, the stack is
+	// non-executable (PT_GNU_STACK), and .dynamic and .got.plt are made
+	// read-only after relocation (PT_GNU_RELRO) when imported functions are
+	// bound at load time.
+	PermPolicyWX
+)
+
+// permPolicyNames maps from access permission policy to policy name.
+var permPolicyNames = map[PermPolicy]string{
+	PermPolicyRWXText: "rwx_text",
+	PermPolicyPE:      "pe",
+	PermPolicyWX:      "wx",
+}
+
+// String returns the string representation of the access permission policy.
+func (policy PermPolicy) String() string {
+	if s, ok := permPolicyNames[policy]; ok {
+		return s
+	}
+	return fmt.Sprintf("PermPolicy(%d)", uint8(policy))
+}
+
+// Set sets the access permission policy based on the given policy name (e.g.
+// "wx").
+func (policy *PermPolicy) Set(s string) error {
+	for p, name := range permPolicyNames {
+		if name == s {
+			*policy = p
+			return nil
+		}
+	}
+	return errors.Errorf("invalid access permission policy %q; expected rwx_text, pe or wx", s)
+}
+
+// UnmarshalText unmarshals the text into policy.
+func (policy *PermPolicy) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*policy = PermPolicyRWXText
+		return nil
+	}
+	return policy.Set(string(text))
+}
+
+// MarshalText returns the textual representation of policy.
+func (policy PermPolicy) MarshalText() ([]byte, error) {
+	return []byte(policy.String()), nil
+}
+
+// SectionNames is a list of section names.
+type SectionNames []string
+
+// Set adds the section names of the given comma-separated string (e.g.
+// ".rdata,.idata").
+func (names *SectionNames) Set(s string) error {
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			return errors.Errorf("invalid section names %q; empty section name", s)
+		}
+		*names = append(*names, name)
+	}
+	return nil
+}
+
+// String returns the string representation of the section names.
+func (names SectionNames) String() string {
+	return strings.Join(names, ",")
+}
+
+// applyPermPolicy applies the given access permission policy to the sections,
+// and makes the sections of the given names writable.
+func applyPermPolicy(sects []*Section, policy PermPolicy, writable SectionNames) error {
+	for _, name := range writable {
+		found := false
+		for _, sect := range sects {
+			if sect.Name == name {
+				sect.Perm |= PermW
+				found = true
+			}
+		}
+		if !found {
+			return errors.Errorf("unable to make section %q writable; no such section", name)
+		}
+	}
+	if policy == PermPolicyRWXText {
+		for _, sect := range sects {
+			if sect.Name == ".text" {
+				// NOTE: we make the .text segment rwx to support binary
+				// instrumentation at runtime. Viewer discression is adviced. Don't do
+				// this at home :)
+				sect.Perm |= PermW
+			}
+		}
+	}
+	return nil
+}
+
+// checkWX checks that none of the given loadable segments are both writable
+// and executable, as required by the W^X access permission policy.
+func checkWX(segs []*Segment) error {
+	for _, seg := range segs {
+		if seg.Perm&(PermW|PermX) == PermW|PermX {
+			return errors.Errorf("loadable segment %q at address %s is writable and executable (%s); rejected by W^X access permission policy", seg.Name(), seg.Sects[0].Addr, seg.Perm)
+		}
+	}
+	return nil
+}
+
+// --- [ Section rules ] -------------------------------------------------------
+
+// A SectionRule overrides how a PE section is relinked.
+type SectionRule struct {
+	// PE section name (e.g. ".reloc").
+	Name string `json:"name"`
+	// Drop section; neither stored in the file nor loaded into memory.
+	Drop bool `json:"drop"`
+	// Store section in the file without allocating it in memory (e.g. debug
+	// sections).
+	NoAlloc bool `json:"noalloc"`
+	// (optional) Access permissions of section (e.g. "r-x", or "---" for an
+	// inaccessible section); or nil to keep the access permissions of the access
+	// permission policy.
+	Perm *Perm `json:"perm"`
+	// Section name in the ELF section header table; or empty to keep the PE
+	// section name.
+	Rename string `json:"rename"`
+	// Virtual address of section; or 0 to keep the address of the PE section.
+	// Code and data of the section are not relocated.
+	Addr Address `json:"addr"`
+}
+
+// applySectionRules applies the given section rules to the sections, and
+// returns the sections sorted by address; dropped sections are removed. Rules
+// are matched against PE section names, and each applied rule is reported to
+// logger.
+//
+// Moving a section is rejected if pinned reports an address within the
+// original address range of the section which is resolved against the original
+// address (e.g. patches, hooks and the import address table), as code and data
+// of the section are not relocated.
+func applySectionRules(sects []*Section, rules []SectionRule, pinned func(start, end Address) (string, bool), logger *log.Logger) ([]*Section, error) {
+	if len(rules) == 0 {
+		return sects, nil
+	}
+	dropped := make(map[*Section]bool)
+	renames := make(map[*Section]string)
+	for _, rule := range rules {
+		if rule.Drop && (rule.NoAlloc || rule.Perm != nil || len(rule.Rename) > 0 || rule.Addr != 0) {
+			return nil, errors.Errorf("invalid rule of section %q; dropped section may not be modified", rule.Name)
+		}
+		if rule.NoAlloc && (rule.Perm != nil || rule.Addr != 0) {
+			return nil, errors.Errorf("invalid rule of section %q; access permissions and address of section not allocated in memory may not be modified", rule.Name)
+		}
+		found := false
+		for _, sect := range sects {
+			if sect.Name != rule.Name || dropped[sect] {
+				continue
+			}
+			found = true
+			if rule.Drop {
+				logger.Printf("section %q at address %s dropped", sect.Name, sect.Addr)
+				dropped[sect] = true
+				continue
+			}
+			if rule.NoAlloc {
+				logger.Printf("section %q at address %s not allocated in memory", sect.Name, sect.Addr)
+				sect.NoAlloc = true
+				// Uninitialized data is only part of the memory image.
+				sect.Size = int64(len(sect.Data))
+			}
+			if rule.Perm != nil && *rule.Perm != sect.Perm {
+				logger.Printf("access permissions of section %q overridden from %s to %s", sect.Name, sect.Perm, *rule.Perm)
+				sect.Perm = *rule.Perm
+			}
+			if rule.Addr != 0 && rule.Addr != sect.Addr {
+				if site, ok := pinned(sect.Addr, sect.Addr+Address(sect.Size)); ok {
+					return nil, errors.Errorf("unable to move section %q from address %s to %s; section contains %s, located by its original address", sect.Name, sect.Addr, rule.Addr, site)
+				}
+				logger.Printf("section %q moved from address %s to %s", sect.Name, sect.Addr, rule.Addr)
+				sect.Addr = rule.Addr
+			}
+			if len(rule.Rename) > 0 {
+				renames[sect] = rule.Rename
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("unable to apply rule of section %q; no such section", rule.Name)
+		}
+	}
+	// Rename sections after all rules are matched against PE section names.
+	var kept []*Section
+	idents := make(map[string]*Section)
+	for _, sect := range sects {
+		if dropped[sect] {
+			continue
+		}
+		if name, ok := renames[sect]; ok {
+			logger.Printf("section %q renamed to %q", sect.Name, name)
+			sect.Name = name
+		}
+		ident := nasmIdent(sect.Name)
+		if isGeneratedIdent(ident) {
+			return nil, errors.Errorf("name %q of section at address %s conflicts with generated identifier %q", sect.Name, sect.Addr, ident)
+		}
+		if prev, ok := idents[ident]; ok {
+			return nil, errors.Errorf("name %q of section at address %s conflicts with name %q of section at address %s", sect.Name, sect.Addr, prev.Name, prev.Addr)
+		}
+		idents[ident] = sect
+		kept = append(kept, sect)
+	}
+	// Sort sections by address, as moved sections may change order.
+	sort.SliceStable(kept, func(i, j int) bool {
+		return kept[i].Addr < kept[j].Addr
+	})
+	return kept, nil
+}
+
+// --- [ Access permissions ] --------------------------------------------------
+
+// Perm specifies the access permissions of a segment or section in memory.
+type Perm uint8
+
+// Access permissions.
+const (
+	// PermR specifies that the memory is readable.
+	PermR Perm = 0x4
+	// PermW specifies that the memory is writeable.
+	PermW Perm = 0x2
+	// PermX specifies that the memory is executable.
+	PermX Perm = 0x1
+)
+
+// ParsePerm returns the memory access permissions represented by the given PE
+// section flags.
+func ParsePerm(flags enum.SectionFlag) Perm {
+	var perm Perm
+	if flags&enum.SectionFlagMemRead != 0 {
+		perm |= PermR
+	}
+	if flags&enum.SectionFlagMemWrite != 0 {
+		perm |= PermW
+	}
+	if flags&enum.SectionFlagMemExecute != 0 {
+		perm |= PermX
+	}
+	return perm
+}
+
+// String returns the string representation of the memory access permissions
+// (e.g. "r-x").
+func (perm Perm) String() string {
+	buf := []byte("---")
+	if perm&PermR != 0 {
+		buf[0] = 'r'
+	}
+	if perm&PermW != 0 {
+		buf[1] = 'w'
+	}
+	if perm&PermX != 0 {
+		buf[2] = 'x'
+	}
+	return string(buf)
+}
+
+// UnmarshalText unmarshals the textual representation of memory access
+// permissions (e.g. "r-x") into perm.
+func (perm *Perm) UnmarshalText(text []byte) error {
+	s := string(text)
+	const flags = "rwx"
+	bits := []Perm{PermR, PermW, PermX}
+	if len(s) != len(flags) {
+		return errors.Errorf("invalid access permissions %q; expected format \"rwx\" (e.g. \"r-x\")", s)
+	}
+	var p Perm
+	for i := range s {
+		switch s[i] {
+		case flags[i]:
+			p |= bits[i]
+		case '-':
+			// nothing to do.
+		default:
+			return errors.Errorf("invalid access permissions %q; expected format \"rwx\" (e.g. \"r-x\")", s)
+		}
+	}
+	*perm = p
+	return nil
+}
+
+// MarshalText returns the textual representation of perm.
+func (perm Perm) MarshalText() ([]byte, error) {
+	return []byte(perm.String()), nil
+}
@@ -0,0 +1,365 @@
+package zelda
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestLoadSegments(t *testing.T) {
+	golden := []struct {
+		name  string
+		sects []*Section
+		// Section names of each segment.
+		want []string
+		// Access permissions of each segment.
+		perms []Perm
+		err   string
+	}{
+		{
+			name: "page aligned",
+			sects: []*Section{
+				sect(".text", 0x401000, 0x1000, 0x1000, PermR|PermX),
+				sect(".rdata", 0x402000, 0x200, 0x200, PermR),
+				sect(".data", 0x403000, 0x200, 0x400, PermR|PermW),
+			},
+			want:  []string{".text", ".rdata", ".data"},
+			perms: []Perm{PermR | PermX, PermR, PermR | PermW},
+		},
+		{
+			name: "adjacent on page boundary",
+			sects: []*Section{
+				sect(".text", 0x401000, 0x200, 0x1000, PermR|PermX),
+				sect(".rdata", 0x402000, 0x200, 0x200, PermR),
+			},
+			want:  []string{".text", ".rdata"},
+			perms: []Perm{PermR | PermX, PermR},
+		},
+		{
+			name: "same page",
+			sects: []*Section{
+				sect(".text", 0x401000, 0x5C6, 0x5C6, PermR|PermX),
+				sect(".rdata", 0x401600, 0x200, 0x200, PermR),
+				sect(".data", 0x401800, 0x200, 0x390, PermR|PermW),
+				sect(".rsrc", 0x402000, 0x200, 0x200, PermR),
+			},
+			want:  []string{".text+.rdata+.data", ".rsrc"},
+			perms: []Perm{PermR | PermW | PermX, PermR},
+		},
+		{
+			name: "uninitialized data sharing page",
+			sects: []*Section{
+				sect(".data", 0x403000, 0x200, 0x1100, PermR|PermW),
+				sect(".rsrc", 0x404200, 0x200, 0x200, PermR),
+			},
+			want:  []string{".data+.rsrc"},
+			perms: []Perm{PermR | PermW},
+		},
+		{
+			name: "not allocated",
+			sects: []*Section{
+				sect(".text", 0x401000, 0x200, 0x200, PermR|PermX),
+				{Name: ".debug", Data: make([]byte, 0x10), Size: 0x10, Addr: 0x401200, NoAlloc: true},
+				sect(".data", 0x402000, 0x200, 0x200, PermR|PermW),
+			},
+			want:  []string{".text", ".data"},
+			perms: []Perm{PermR | PermX, PermR | PermW},
+		},
+		{
+			name: "overlapping",
+			sects: []*Section{
+				sect(".text", 0x401000, 0x200, 0x400, PermR|PermX),
+				sect(".data", 0x401200, 0x200, 0x200, PermR|PermW),
+			},
+			err: `section ".data" at address 0x401200 overlaps section ".text"`,
+		},
+	}
+	for _, g := range golden {
+		segs, err := loadSegments(g.sects, discard)
+		if !checkErr(t, g.name, err, g.err) {
+			continue
+		}
+		var names []string
+		var perms []Perm
+		for _, seg := range segs {
+			names = append(names, seg.Name())
+			perms = append(perms, seg.Perm)
+		}
+		if !reflect.DeepEqual(names, g.want) {
+			t.Errorf("%s: segments mismatch; expected %q, got %q", g.name, g.want, names)
+		}
+		if !reflect.DeepEqual(perms, g.perms) {
+			t.Errorf("%s: access permissions mismatch; expected %v, got %v", g.name, g.perms, perms)
+		}
+	}
+}
+
+func TestSegmentStartNext(t *testing.T) {
+	seg := &Segment{
+		Sects: []*Section{
+			sect(".text", 0x401010, 0x5C6, 0x5C6, PermR|PermX),
+			sect(".rdata", 0x401600, 0x200, 0x200, PermR),
+		},
+	}
+	if got, want := seg.start(0), Address(0x401000); got != want {
+		t.Errorf("start of first section mismatch; expected %s, got %s", want, got)
+	}
+	if got, want := seg.start(1), Address(0x401600); got != want {
+		t.Errorf("start of second section mismatch; expected %s, got %s", want, got)
+	}
+	if got, want := seg.next(0), Address(0x401600); got != want {
+		t.Errorf("next of first section mismatch; expected %s, got %s", want, got)
+	}
+	if got := seg.next(1); got != 0 {
+		t.Errorf("next of last section mismatch; expected 0, got %s", got)
+	}
+}
+
+func TestApplyPermPolicy(t *testing.T) {
+	golden := []struct {
+		name     string
+		policy   PermPolicy
+		writable SectionNames
+		// Access permissions of .text, .rdata and .data.
+		want []Perm
+		err  string
+		// Error of W^X check.
+		wxErr string
+	}{
+		{
+			name:   "rwx_text",
+			policy: PermPolicyRWXText,
+			want:   []Perm{PermR | PermW | PermX, PermR, PermR | PermW},
+			wxErr:  `loadable segment ".text" at address 0x401000 is writable and executable (rwx)`,
+		},
+		{
+			name:   "pe",
+			policy: PermPolicyPE,
+			want:   []Perm{PermR | PermX, PermR, PermR | PermW},
+		},
+		{
+			name:   "wx",
+			policy: PermPolicyWX,
+			want:   []Perm{PermR | PermX, PermR, PermR | PermW},
+		},
+		{
+			name:     "wx writable .rdata",
+			policy:   PermPolicyWX,
+			writable: SectionNames{".rdata"},
+			want:     []Perm{PermR | PermX, PermR | PermW, PermR | PermW},
+		},
+		{
+			name:     "wx writable .text",
+			policy:   PermPolicyWX,
+			writable: SectionNames{".text"},
+			want:     []Perm{PermR | PermW | PermX, PermR, PermR | PermW},
+			wxErr:    `loadable segment ".text" at address 0x401000 is writable and executable (rwx)`,
+		},
+		{
+			name:     "missing writable section",
+			policy:   PermPolicyPE,
+			writable: SectionNames{".bss"},
+			err:      `unable to make section ".bss" writable; no such section`,
+		},
+	}
+	for _, g := range golden {
+		sects := []*Section{
+			sect(".text", 0x401000, 0x200, 0x200, PermR|PermX),
+			sect(".rdata", 0x402000, 0x200, 0x200, PermR),
+			sect(".data", 0x403000, 0x200, 0x200, PermR|PermW),
+		}
+		err := applyPermPolicy(sects, g.policy, g.writable)
+		if !checkErr(t, g.name, err, g.err) {
+			continue
+		}
+		var perms []Perm
+		for _, sect := range sects {
+			perms = append(perms, sect.Perm)
+		}
+		if !reflect.DeepEqual(perms, g.want) {
+			t.Errorf("%s: access permissions mismatch; expected %v, got %v", g.name, g.want, perms)
+		}
+		segs, err := loadSegments(sects, discard)
+		if err != nil {
+			t.Errorf("%s: unable to load segments; %v", g.name, err)
+			continue
+		}
+		checkErr(t, g.name, checkWX(segs), g.wxErr)
+	}
+}
+
+func TestCheckWXMerged(t *testing.T) {
+	// Sections of different access permissions sharing a page are merged into a
+	// writable and executable segment.
+	sects := []*Section{
+		sect(".text", 0x401000, 0x200, 0x200, PermR|PermX),
+		sect(".data", 0x401200, 0x200, 0x200, PermR|PermW),
+	}
+	segs, err := loadSegments(sects, discard)
+	if err != nil {
+		t.Fatalf("unable to load segments; %v", err)
+	}
+	want := `loadable segment ".text+.data" at address 0x401000 is writable and executable (rwx)`
+	checkErr(t, "merged", checkWX(segs), want)
+}
+
+func TestPermPolicySet(t *testing.T) {
+	golden := []struct {
+		s    string
+		want PermPolicy
+		err  string
+	}{
+		{s: "rwx_text", want: PermPolicyRWXText},
+		{s: "pe", want: PermPolicyPE},
+		{s: "wx", want: PermPolicyWX},
+		{s: "w^x", err: `invalid access permission policy "w^x"`},
+	}
+	for _, g := range golden {
+		var policy PermPolicy
+		err := policy.Set(g.s)
+		if !checkErr(t, g.s, err, g.err) {
+			continue
+		}
+		if policy != g.want {
+			t.Errorf("%s: access permission policy mismatch; expected %v, got %v", g.s, g.want, policy)
+		}
+		if s := policy.String(); s != g.s {
+			t.Errorf("%s: string mismatch; expected %q, got %q", g.s, g.s, s)
+		}
+	}
+}
+
+func TestApplySectionRules(t *testing.T) {
+	golden := []struct {
+		name  string
+		rules string
+		// Pinned address of patches.
+		pinned Address
+		// Name, address, access permissions and size of each section; with a
+		// "noalloc" suffix for sections not allocated in memory.
+		want []string
+		err  string
+	}{
+		{
+			name:  "no rules",
+			rules: `[]`,
+			want:  []string{".text 0x401000 r-x 0x200", ".data 0x402000 rw- 0x200", ".reloc 0x403000 r-- 0x100"},
+		},
+		{
+			name:  "drop",
+			rules: `[{"name": ".reloc", "drop": true}]`,
+			want:  []string{".text 0x401000 r-x 0x200", ".data 0x402000 rw- 0x200"},
+		},
+		{
+			name:  "noalloc",
+			rules: `[{"name": ".data", "noalloc": true}]`,
+			want:  []string{".text 0x401000 r-x 0x200", ".data 0x402000 rw- 0x100 noalloc", ".reloc 0x403000 r-- 0x100"},
+		},
+		{
+			name:  "perm",
+			rules: `[{"name": ".text", "perm": "rwx"}, {"name": ".reloc", "perm": "---"}]`,
+			want:  []string{".text 0x401000 rwx 0x200", ".data 0x402000 rw- 0x200", ".reloc 0x403000 --- 0x100"},
+		},
+		{
+			name:  "rename",
+			rules: `[{"name": ".data", "rename": ".reloc"}, {"name": ".reloc", "rename": ".data"}]`,
+			want:  []string{".text 0x401000 r-x 0x200", ".reloc 0x402000 rw- 0x200", ".data 0x403000 r-- 0x100"},
+		},
+		{
+			name:  "move",
+			rules: `[{"name": ".data", "addr": "0x410000"}]`,
+			want:  []string{".text 0x401000 r-x 0x200", ".reloc 0x403000 r-- 0x100", ".data 0x410000 rw- 0x200"},
+		},
+		{
+			name:   "move unpinned",
+			rules:  `[{"name": ".data", "addr": "0x410000"}]`,
+			pinned: 0x401010,
+			want:   []string{".text 0x401000 r-x 0x200", ".reloc 0x403000 r-- 0x100", ".data 0x410000 rw- 0x200"},
+		},
+		{
+			name:   "move pinned",
+			rules:  `[{"name": ".data", "addr": "0x410000"}]`,
+			pinned: 0x402010,
+			err:    `unable to move section ".data" from address 0x402000 to 0x410000; section contains patch at 0x402010`,
+		},
+		{
+			name:  "missing section",
+			rules: `[{"name": ".bss", "drop": true}]`,
+			err:   `unable to apply rule of section ".bss"; no such section`,
+		},
+		{
+			name:  "drop conflict",
+			rules: `[{"name": ".reloc", "drop": true, "rename": ".rel"}]`,
+			err:   `invalid rule of section ".reloc"; dropped section may not be modified`,
+		},
+		{
+			name:  "noalloc perm conflict",
+			rules: `[{"name": ".reloc", "noalloc": true, "perm": "r--"}]`,
+			err:   `invalid rule of section ".reloc"; access permissions and address of section not allocated in memory may not be modified`,
+		},
+		{
+			name:  "noalloc addr conflict",
+			rules: `[{"name": ".reloc", "noalloc": true, "addr": "0x410000"}]`,
+			err:   `invalid rule of section ".reloc"; access permissions and address of section not allocated in memory may not be modified`,
+		},
+		{
+			name:  "rename conflict",
+			rules: `[{"name": ".data", "rename": ".text"}]`,
+			err:   `name ".text" of section at address 0x402000 conflicts with name ".text" of section at address 0x401000`,
+		},
+		{
+			name:  "rename generated identifier",
+			rules: `[{"name": ".data", "rename": "got_plt"}]`,
+			err:   `name "got_plt" of section at address 0x402000 conflicts with generated identifier "got_plt"`,
+		},
+		{
+			name:  "rename generated file offset",
+			rules: `[{"name": ".data", "rename": "plt_off"}]`,
+			err:   `conflicts with generated identifier "plt_off"`,
+		},
+		{
+			name:  "invalid perm",
+			rules: `[{"name": ".data", "perm": "rwz"}]`,
+			err:   `invalid access permissions "rwz"`,
+		},
+		{
+			name:  "empty perm",
+			rules: `[{"name": ".data", "perm": ""}]`,
+			err:   `invalid access permissions ""`,
+		},
+	}
+	for _, g := range golden {
+		sects := []*Section{
+			sect(".text", 0x401000, 0x200, 0x200, PermR|PermX),
+			sect(".data", 0x402000, 0x100, 0x200, PermR|PermW),
+			sect(".reloc", 0x403000, 0x100, 0x100, PermR),
+		}
+		var rules []SectionRule
+		if err := json.Unmarshal([]byte(g.rules), &rules); err != nil {
+			checkErr(t, g.name, err, g.err)
+			continue
+		}
+		pinned := func(start, end Address) (string, bool) {
+			if start <= g.pinned && g.pinned < end {
+				return fmt.Sprintf("patch at %s", g.pinned), true
+			}
+			return "", false
+		}
+		got, err := applySectionRules(sects, rules, pinned, discard)
+		if !checkErr(t, g.name, err, g.err) {
+			continue
+		}
+		var descs []string
+		for _, sect := range got {
+			desc := fmt.Sprintf("%s %s %s 0x%X", sect.Name, sect.Addr, sect.Perm, sect.Size)
+			if sect.NoAlloc {
+				desc += " noalloc"
+			}
+			descs = append(descs, desc)
+		}
+		if !reflect.DeepEqual(descs, g.want) {
+			t.Errorf("%s: sections mismatch; expected %q, got %q", g.name, g.want, descs)
+		}
+	}
+}
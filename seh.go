@@ -0,0 +1,85 @@
+package zelda
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// SEHLib is the file name of the SEH runtime library, which translates Linux
+// signals into structured exception handling (SEH) dispatch over the chain of
+// exception registration records at fs:[0].
+const SEHLib = "libzelda_seh.so"
+
+// sehLib returns the SEH runtime library, as imported by relinked executables
+// with SEH dispatch. The startup stub registers the signal handlers of the SEH
+// runtime through zelda_seh_init.
+func sehLib() Library {
+	return Library{
+		Name:     libName(SEHLib),
+		Filename: SEHLib,
+		Funcs:    []Func{{Name: "zelda_seh_init"}},
+	}
+}
+
+// sehArgSizes maps from function name to stack argument size of the __stdcall
+// functions implemented by the SEH runtime library. The SEH runtime relies on
+// these functions being called through the __stdcall thunks of zelda, as
+// RaiseException locates the address of its caller through the stack frame of
+// the thunk.
+var sehArgSizes = map[string]int{
+	"RaiseException": 16,
+	"RtlUnwind":      16,
+}
+
+// setSEHArgSizes sets the stack argument sizes of imported functions
+// implemented by the SEH runtime library, overriding the stack argument sizes
+// of -stdcall and -protos.
+func setSEHArgSizes(libs []Library) {
+	for i := range libs {
+		lib := &libs[i]
+		for j := range lib.Funcs {
+			fn := &lib.Funcs[j]
+			if argSize, ok := sehArgSizes[fn.Name]; ok {
+				fn.ArgSize = argSize
+			}
+		}
+	}
+}
+
+// SEHFiles returns the file names of the C source file and Makefile generated
+// for the SEH runtime library.
+func SEHFiles() []string {
+	return []string{libName(SEHLib) + ".c", "Makefile"}
+}
+
+// WriteSEH writes the C source file and Makefile of the SEH runtime library to
+// dir.
+func WriteSEH(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	data := map[string]interface{}{
+		"Name":     libName(SEHLib),
+		"Filename": SEHLib,
+	}
+	files := SEHFiles()
+	tmplNames := []string{"seh_runtime.tmpl", "seh_makefile.tmpl"}
+	for i, tmplName := range tmplNames {
+		t, err := loadTemplate(tmplName)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		buf := &bytes.Buffer{}
+		if err := t.Execute(buf, data); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, files[i]), buf.Bytes(), 0644); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package zelda
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"unicode"
+
+	"github.com/pkg/errors"
+)
+
+// ShimFiles returns the file names of the C source files and Makefile
+// generated for the shim of the given shared library.
+func ShimFiles(lib Library) []string {
+	return []string{lib.Name + ".c", "zelda_shim.h", "zelda_shim.c", "Makefile"}
+}
+
+// WriteShim writes C source files and a Makefile of a skeleton shim of the given
+// shared library to dir. The shim has one stub per imported function, which
+// logs that the function is unimplemented and aborts. Stubs are typed by the
+// prototypes of imported functions, if known.
+func WriteShim(dir string, lib Library) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	data := map[string]interface{}{
+		"Lib":   lib,
+		"Funcs": shimFuncs(lib),
+	}
+	files := ShimFiles(lib)
+	tmplNames := []string{"shim_lib.tmpl", "shim_h.tmpl", "shim_runtime.tmpl", "shim_makefile.tmpl"}
+	for i, tmplName := range tmplNames {
+		t, err := loadTemplate(tmplName)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		buf := &bytes.Buffer{}
+		if err := t.Execute(buf, data); err != nil {
+			return errors.WithStack(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, files[i]), buf.Bytes(), 0644); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// shimFunc is a stub of an imported function in a shim.
+type shimFunc struct {
+	// Function name, as exported by the shim.
+	Name string
+	// C identifier of stub; either the function name or a generated identifier
+	// if the function name is not a C identifier (e.g. "_Sleep@4").
+	Ident string
+	// (optional) Function prototype.
+	Proto *Proto
+	// Size in bytes of the stack arguments of __stdcall functions; or 0 for
+	// __cdecl functions.
+	ArgSize int
+}
+
+// Decl returns the C declaration of the stub.
+func (fn shimFunc) Decl() string {
+	if fn.Proto == nil {
+		return fmt.Sprintf("void %s(void)", fn.Ident)
+	}
+	return fmt.Sprintf("%s(%s)", cDecl(fn.Proto.Ret, fn.Ident), fn.Proto.ParamList())
+}
+
+// Comment returns the function prototype of the stub, as documented by the
+// shim.
+func (fn shimFunc) Comment() string {
+	switch {
+	case fn.Proto == nil && fn.ArgSize > 0:
+		return fmt.Sprintf("Unknown prototype; __stdcall with %d bytes of arguments.", fn.ArgSize)
+	case fn.Proto == nil:
+		return "Unknown prototype."
+	case fn.Proto.Stdcall:
+		return fmt.Sprintf("%s WINAPI %s(%s)", fn.Proto.Ret, fn.Proto.Name, fn.Proto.ParamList())
+	default:
+		return fn.Proto.String()
+	}
+}
+
+// shimFuncs returns the stubs of the imported functions of the given shared
+// library. Functions imported more than once (e.g. through multiple import
+// descriptors of the same DLL) are only stubbed once.
+func shimFuncs(lib Library) []shimFunc {
+	var funcs []shimFunc
+	present := make(map[string]bool)
+	for i, fn := range lib.Funcs {
+		if present[fn.Name] {
+			// skip duplicate function names
+			continue
+		}
+		present[fn.Name] = true
+		f := shimFunc{
+			Name:    fn.Name,
+			Ident:   fn.Name,
+			Proto:   fn.Proto,
+			ArgSize: fn.ArgSize,
+		}
+		if !isIdent(fn.Name) {
+			f.Ident = fmt.Sprintf("zelda_stub_%d", i)
+		}
+		funcs = append(funcs, f)
+	}
+	return funcs
+}
+
+// isIdent reports whether the given string is a C identifier.
+func isIdent(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i, r := range s {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,28 @@
+package zelda
+
+import "testing"
+
+func TestShimFuncsDuplicate(t *testing.T) {
+	// Functions imported through multiple import descriptors of the same DLL.
+	lib := Library{
+		Name:     "kernel32",
+		Filename: "libkernel32.so",
+		Funcs: []Func{
+			{Name: "GetProcAddress"},
+			{Name: "LoadLibraryExW"},
+			{Name: "GetProcAddress"},
+			{Name: "LoadLibraryExW"},
+			{Name: "ExitProcess"},
+		},
+	}
+	want := []string{"GetProcAddress", "LoadLibraryExW", "ExitProcess"}
+	funcs := shimFuncs(lib)
+	if len(funcs) != len(want) {
+		t.Fatalf("number of stubs mismatch; expected %d, got %d", len(want), len(funcs))
+	}
+	for i, fn := range funcs {
+		if fn.Ident != want[i] {
+			t.Errorf("stub %d: identifier mismatch; expected %q, got %q", i, want[i], fn.Ident)
+		}
+	}
+}
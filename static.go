@@ -1,17 +1,17 @@
-package main
+package zelda
 
 // StaticLib is a statically linked library.
 type StaticLib struct {
 	// File name of statically linked library.
-	Filename string
+	Filename string `json:"filename"`
 	// Statically linked functions.
-	Funcs []StaticFunc
+	Funcs []StaticFunc `json:"funcs"`
 }
 
 // StaticFunc is a statically linked function.
 type StaticFunc struct {
 	// Address of statically linked function in executable.
-	Addr Address
+	Addr Address `json:"addr"`
 	// Function name.
-	Name string
+	Name string `json:"name"`
 }
@@ -0,0 +1,229 @@
+package zelda
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/mewmew/pe"
+)
+
+// --- [ Test PE files ] -------------------------------------------------------
+
+const (
+	// File alignment of test PE files.
+	testFileAlign = 0x200
+	// Section alignment of test PE files.
+	testSectAlign = 0x1000
+)
+
+// testPE is a minimal 32-bit PE file of tests.
+type testPE struct {
+	// Image base.
+	imageBase uint32
+	// Relative address of entry point.
+	entry uint32
+	// Size of headers; or 0 for the file alignment.
+	hdrsSize uint32
+	// Dynamic-link library.
+	dll bool
+	// Sections, in order of relative address.
+	sects []testSect
+	// Imported libraries; stored in an .idata section following the sections.
+	imps []testImport
+}
+
+// testSect is a section of a test PE file.
+type testSect struct {
+	// Section name.
+	name string
+	// Relative address of section.
+	relAddr uint32
+	// Virtual size of section; or 0 if unset.
+	virtSize uint32
+	// Initialized contents of section; padded to the file alignment.
+	data []byte
+	// Section characteristics.
+	flags uint32
+}
+
+// testImport is an imported library of a test PE file.
+type testImport struct {
+	// DLL file name.
+	dll string
+	// Imported functions.
+	funcs []string
+}
+
+// bytes returns the contents of the test PE file.
+func (p testPE) bytes() []byte {
+	sects := append([]testSect(nil), p.sects...)
+	// Relative address and size of import table.
+	var impDir [2]uint32
+	if len(p.imps) > 0 {
+		relAddr := uint32(testSectAlign)
+		if len(sects) > 0 {
+			last := sects[len(sects)-1]
+			size := last.virtSize
+			if size == 0 {
+				size = uint32(len(last.data))
+			}
+			relAddr = alignUp32(last.relAddr+size, testSectAlign)
+		}
+		idata := p.idata(relAddr)
+		impDir = [2]uint32{relAddr, uint32(20 * (len(p.imps) + 1))}
+		sects = append(sects, testSect{name: ".idata", relAddr: relAddr, virtSize: uint32(len(idata)), data: idata, flags: 0xC0000040})
+	}
+	hdrsSize := p.hdrsSize
+	if hdrsSize == 0 {
+		hdrsSize = testFileAlign
+	}
+	imageSize := uint32(testSectAlign)
+	for _, sect := range sects {
+		size := sect.virtSize
+		if size == 0 {
+			size = uint32(len(sect.data))
+		}
+		imageSize = alignUp32(sect.relAddr+size, testSectAlign)
+	}
+	buf := &bytes.Buffer{}
+	write := func(v interface{}) {
+		if err := binary.Write(buf, binary.LittleEndian, v); err != nil {
+			panic(err)
+		}
+	}
+	// DOS header.
+	dosHdr := make([]byte, 0x40)
+	copy(dosHdr, "MZ")
+	binary.LittleEndian.PutUint32(dosHdr[0x3C:], uint32(len(dosHdr)))
+	buf.Write(dosHdr)
+	// COFF file header.
+	buf.WriteString("PE\x00\x00")
+	chars := uint16(0x0102) // IMAGE_FILE_EXECUTABLE_IMAGE | IMAGE_FILE_32BIT_MACHINE
+	if p.dll {
+		chars |= 0x2000 // IMAGE_FILE_DLL
+	}
+	write([]uint16{0x014C, uint16(len(sects))})
+	write([]uint32{0, 0, 0})
+	write([]uint16{0xE0, chars})
+	// Optional header.
+	write([]uint16{0x010B, 0})
+	write([]uint32{0, 0, 0, p.entry, 0, 0, p.imageBase, testSectAlign, testFileAlign})
+	write([]uint16{4, 0, 0, 0, 4, 0})
+	write([]uint32{0, imageSize, hdrsSize, 0})
+	write([]uint16{3, 0})
+	write([]uint32{0x100000, 0x1000, 0x100000, 0x1000, 0, 16})
+	// Data directories.
+	dataDirs := make([][2]uint32, 16)
+	dataDirs[1] = impDir
+	write(dataDirs)
+	// Section headers.
+	offset := alignUp32(hdrsSize, testFileAlign)
+	for _, sect := range sects {
+		var name [8]byte
+		copy(name[:], sect.name)
+		write(name)
+		dataSize := alignUp32(uint32(len(sect.data)), testFileAlign)
+		dataOffset := uint32(0)
+		if dataSize > 0 {
+			dataOffset = offset
+		}
+		write([]uint32{sect.virtSize, sect.relAddr, dataSize, dataOffset, 0, 0, 0, sect.flags})
+		offset += dataSize
+	}
+	// Section contents.
+	buf.Write(make([]byte, int(alignUp32(hdrsSize, testFileAlign))-buf.Len()))
+	for _, sect := range sects {
+		buf.Write(sect.data)
+		buf.Write(make([]byte, int(alignUp32(uint32(len(sect.data)), testFileAlign))-len(sect.data)))
+	}
+	return buf.Bytes()
+}
+
+// idata returns the contents of the .idata section at the given relative
+// address, containing the import directories, the import address tables of
+// the imported libraries (contiguous, as output by linkers), their import name
+// tables and their names.
+func (p testPE) idata(relAddr uint32) []byte {
+	size := 20 * (len(p.imps) + 1)
+	iatOffset := size
+	for _, imp := range p.imps {
+		size += 4 * (len(imp.funcs) + 1)
+	}
+	intOffset := size
+	size += size - iatOffset
+	buf := make([]byte, size)
+	put := func(offset int, v int) {
+		binary.LittleEndian.PutUint32(buf[offset:], relAddr+uint32(v))
+	}
+	for i, imp := range p.imps {
+		for j, funcName := range imp.funcs {
+			put(intOffset+4*j, len(buf))
+			put(iatOffset+4*j, len(buf))
+			// Hint and name.
+			buf = append(buf, 0, 0)
+			buf = append(buf, funcName...)
+			buf = append(buf, 0)
+			if len(buf)%2 != 0 {
+				buf = append(buf, 0)
+			}
+		}
+		put(20*i, intOffset)
+		put(20*i+12, len(buf))
+		put(20*i+16, iatOffset)
+		buf = append(buf, imp.dll...)
+		buf = append(buf, 0)
+		iatOffset += 4 * (len(imp.funcs) + 1)
+		intOffset += 4 * (len(imp.funcs) + 1)
+	}
+	return buf
+}
+
+// parse parses the test PE file.
+func (p testPE) parse(t *testing.T) *pe.File {
+	t.Helper()
+	file, err := pe.ParseBytes(p.bytes())
+	if err != nil {
+		t.Fatalf("unable to parse test PE file; %v", err)
+	}
+	return file
+}
+
+// write writes the test PE file to a temporary directory of the test, and
+// returns its path.
+func (p testPE) write(t *testing.T) string {
+	t.Helper()
+	pePath := filepath.Join(t.TempDir(), "test.exe")
+	if err := ioutil.WriteFile(pePath, p.bytes(), 0644); err != nil {
+		t.Fatalf("unable to write test PE file; %v", err)
+	}
+	return pePath
+}
+
+// alignUp32 rounds x up to the nearest multiple of align.
+func alignUp32(x, align uint32) uint32 {
+	return (x + align - 1) &^ (align - 1)
+}
+
+// relink relinks the test PE file using the given relink options, with the
+// default base address and number of traced stack arguments unless specified,
+// and returns the NASM listing and relink result.
+func (p testPE) relink(t *testing.T, opts Options) (string, *Result) {
+	t.Helper()
+	if opts.Base == 0 {
+		opts.Base = DefaultBase
+	}
+	if opts.TraceArgs == 0 {
+		opts.TraceArgs = DefaultTraceArgs
+	}
+	r := NewRelinker(opts)
+	r.Logger = discard
+	buf := &bytes.Buffer{}
+	res, err := r.Relink(buf, p.write(t))
+	if err != nil {
+		t.Fatalf("unable to relink test PE file; %+v", err)
+	}
+	return buf.String(), res
+}
@@ -0,0 +1,40 @@
+package zelda
+
+import (
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+)
+
+// discard is a logger discarding its output.
+var discard = log.New(ioutil.Discard, "", 0)
+
+// checkErr reports whether err is nil and no error was expected; an error is
+// reported to t if err does not contain the expected error message.
+func checkErr(t *testing.T, name string, err error, want string) bool {
+	t.Helper()
+	switch {
+	case err == nil && len(want) == 0:
+		return true
+	case err == nil:
+		t.Errorf("%s: expected error containing %q, got nil", name, want)
+	case len(want) == 0:
+		t.Errorf("%s: unexpected error; %v", name, err)
+	case !strings.Contains(err.Error(), want):
+		t.Errorf("%s: error mismatch; expected error containing %q, got %q", name, want, err.Error())
+	}
+	return false
+}
+
+// sect returns a new section of the given name, address, initialized size,
+// total size and access permissions.
+func sect(name string, addr Address, dataSize, size int64, perm Perm) *Section {
+	return &Section{
+		Name: name,
+		Data: make([]byte, dataSize),
+		Size: size,
+		Addr: addr,
+		Perm: perm,
+	}
+}
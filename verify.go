@@ -0,0 +1,96 @@
+package zelda
+
+import (
+	"debug/elf"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// VerifyELF checks the structure of the given ELF file, and that the given
+// sections of the original PE file are mapped with sufficient access
+// permissions. The returned list contains a description of each problem
+// encountered.
+func VerifyELF(elfPath string, sects []*Section) ([]string, error) {
+	f, err := elf.Open(elfPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+	var problems []string
+	if f.Class != elf.ELFCLASS32 {
+		problems = append(problems, fmt.Sprintf("invalid class; expected %v, got %v", elf.ELFCLASS32, f.Class))
+	}
+	if f.Machine != elf.EM_386 {
+		problems = append(problems, fmt.Sprintf("invalid machine; expected %v, got %v", elf.EM_386, f.Machine))
+	}
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		problems = append(problems, fmt.Sprintf("invalid type; expected %v or %v, got %v", elf.ET_EXEC, elf.ET_DYN, f.Type))
+	}
+	// Check loadable segments.
+	var loads []*elf.Prog
+	hasInterp, hasDynamic := false, false
+	for _, prog := range f.Progs {
+		switch prog.Type {
+		case elf.PT_INTERP:
+			hasInterp = true
+		case elf.PT_DYNAMIC:
+			hasDynamic = true
+		case elf.PT_LOAD:
+			if prog.Vaddr%pageSize != prog.Off%pageSize {
+				problems = append(problems, fmt.Sprintf("loadable segment at address 0x%08X; virtual address and file offset (0x%X) not congruent modulo page size", prog.Vaddr, prog.Off))
+			}
+			if prog.Filesz > prog.Memsz {
+				problems = append(problems, fmt.Sprintf("loadable segment at address 0x%08X; file size (0x%X) exceeds memory size (0x%X)", prog.Vaddr, prog.Filesz, prog.Memsz))
+			}
+			for _, other := range loads {
+				if prog.Vaddr < other.Vaddr+other.Memsz && other.Vaddr < prog.Vaddr+prog.Memsz {
+					problems = append(problems, fmt.Sprintf("loadable segment at address 0x%08X overlaps loadable segment at address 0x%08X", prog.Vaddr, other.Vaddr))
+				}
+			}
+			loads = append(loads, prog)
+		}
+	}
+	if f.Type == elf.ET_EXEC && !hasInterp {
+		problems = append(problems, "missing interpreter program header")
+	}
+	if !hasDynamic {
+		problems = append(problems, "missing dynamic array program header")
+	} else if _, err := f.ImportedLibraries(); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid dynamic array; %v", err))
+	}
+	// Check entry point.
+	if f.Type == elf.ET_EXEC || f.Entry != 0 {
+		if prog := findLoad(loads, f.Entry); prog == nil || prog.Flags&elf.PF_X == 0 {
+			problems = append(problems, fmt.Sprintf("entry point 0x%08X not within executable loadable segment", f.Entry))
+		}
+	}
+	// Check mapping of sections of original PE file.
+	for _, sect := range sects {
+		want := elfProgFlag(sect.Perm)
+		end := uint64(sect.Addr) + uint64(sect.Size)
+		for addr := uint64(sect.Addr); addr < end; {
+			prog := findLoad(loads, addr)
+			if prog == nil {
+				problems = append(problems, fmt.Sprintf("address 0x%08X of section %q not mapped by loadable segment", addr, sect.Name))
+				break
+			}
+			if prog.Flags&want != want {
+				problems = append(problems, fmt.Sprintf("section %q mapped by loadable segment at address 0x%08X with insufficient access permissions; expected %v, got %v", sect.Name, prog.Vaddr, want, prog.Flags))
+			}
+			addr = prog.Vaddr + prog.Memsz
+		}
+	}
+	return problems, nil
+}
+
+// findLoad returns the loadable segment containing the given address; or nil if
+// not present.
+func findLoad(loads []*elf.Prog, addr uint64) *elf.Prog {
+	for _, prog := range loads {
+		if prog.Vaddr <= addr && addr < prog.Vaddr+prog.Memsz {
+			return prog
+		}
+	}
+	return nil
+}